@@ -0,0 +1,346 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var (
+	err_mac_exists = errors.New("MAC address already authorized on that port")
+	err_pf_exists = errors.New("profile already exists")
+	err_pf_query = errors.New("invalid profile query")
+)
+
+// ParamId builds an identity out of the URI params, for use with DB paths
+func (ar *ApiRequest) ParamId() (Identity, error) {
+	in := make(map[string]interface{})
+	for _, k := range required {
+		if v, ok := ar.param[k[1:]]; ok { in[k] = v }
+	}
+	return ar.api.S.NewIdentity(in)
+}
+
+// ListDir returns names of all subdirectories in given DB path
+func (db *DB) ListDir(path string) ([]string, error) {
+	files, err := db.st.List(path)
+	if err != nil { return nil, err }
+
+	ret := []string{}
+	for _, f := range files {
+		if f.IsDir { ret = append(ret, f.Name) }
+	}
+	return ret, nil
+}
+
+// ReadMac returns the identity stored for given MAC (or an empty one)
+func (db *DB) ReadMac(id Identity) (Identity, error) {
+	path := db.MacPath(id)
+	if stat, err := db.st.Stat(path); err != nil {
+		return nil, err
+	} else if !stat.IsDir {
+		return nil, err_mac_file
+	}
+
+	jsonb, err := db.st.Read(path + "/identity.json")
+	if os.IsNotExist(err) { return make(Identity), nil }
+	if err != nil { return nil, err }
+
+	return db.S.ReadIdentity(bytes.NewReader(jsonb))
+}
+
+// AddMac authorizes given MAC on given switch port
+func (db *DB) AddMac(id Identity) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	path := db.MacPath(id)
+	if _, err := db.st.Stat(path); err == nil { return err_mac_exists }
+
+	dbg(1, "db", "%s: adding MAC", db.Tag(id))
+	if err := db.st.Mkdir(path); err != nil { return err }
+
+	db.mac_added(id)
+	return nil
+}
+
+// DelMac removes given MAC, along with its stored identity
+func (db *DB) DelMac(id Identity) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	dbg(1, "db", "%s: deleting MAC", db.Tag(id))
+	if err := db.st.Remove(db.MacPath(id)); err != nil { return err }
+
+	db.mac_removed(id)
+	return nil
+}
+
+// MoveMac moves given MAC to another switch port, along with its stored identity
+func (db *DB) MoveMac(id Identity, to Identity) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	src, dst := db.MacPath(id), db.MacPath(to)
+	if _, err := db.st.Stat(src); err != nil { return err }
+	if _, err := db.st.Stat(dst); err == nil { return err_mac_exists }
+
+	dbg(1, "db", "%s: moving MAC to %s", db.Tag(id), db.Tag(to))
+	return db.move_mac(id, to)
+}
+
+// move_mac renames the MAC directory and rewrites the location stored in identity file
+//
+// NB: db.mutex must be held
+func (db *DB) move_mac(id Identity, to Identity) error {
+	dst := db.MacPath(to)
+	if err := db.st.Rename(db.MacPath(id), dst); err != nil { return err }
+	db.mac_removed(id)
+	db.mac_added(to)
+
+	old, err := db.ReadMac(to)
+	if err != nil || len(old) == 0 { return err }
+	for _, k := range required { old[k] = to[k] }
+
+	jsonb, err := old.JSON()
+	if err == nil { err = db.st.Write(dst + "/identity.json", jsonb) }
+	return err
+}
+
+// ProfileQstring converts an URI path into a qstring, escaping each pf_query level
+func (db *DB) ProfileQstring(path string) (string, error) {
+	query := []string{}
+	for _, v := range strings.Split(path, "/") {
+		if len(v) == 0 { continue }
+		v = escape(v)
+		if len(v) == 0 { return "", err_pf_query }
+		query = append(query, v)
+	}
+
+	if len(query) == 0 || len(query) > len(pf_query) { return "", err_pf_query }
+	return strings.Join(query, "/"), nil
+}
+
+// ReadProfileAt reads the profile stored at given qstring
+func (db *DB) ReadProfileAt(qstring string) (Profile, error) {
+	jsonb, err := db.st.Read(db.ProfilePath(qstring, "profile.json"))
+	if err != nil { return nil, err }
+
+	return db.S.ReadProfile(bytes.NewReader(jsonb))
+}
+
+// IsLocal returns true if profile at given qstring was authored locally
+func (db *DB) IsLocal(qstring string) bool {
+	pf, err := db.ReadProfileAt(qstring)
+	if err != nil { return false }
+
+	local, _ := pf["@local"].(bool)
+	return local
+}
+
+// WriteProfile stores a locally authored profile at given qstring
+func (db *DB) WriteProfile(qstring string, in map[string]interface{}, create bool) (Profile, error) {
+	pfpath := db.ProfilePath(qstring, "profile.json")
+	if _, err := db.st.Stat(pfpath); err == nil && create { return nil, err_pf_exists }
+
+	pf, err := db.S.NewLocalProfile(in)
+	if err != nil { return nil, err }
+
+	jsonb, err := pf.JSON()
+	if err != nil { return nil, err }
+
+	dbg(1, "db", "%s: writing local profile", qstring)
+	if err := db.st.Write(pfpath, jsonb); err != nil { return pf, err }
+
+	db.S.cache.SetLocal(qstring, true)
+	return pf, nil
+}
+
+// DelProfile removes the profile stored at given qstring (more specific profiles are kept)
+func (db *DB) DelProfile(qstring string) error {
+	dbg(1, "db", "%s: deleting profile", qstring)
+	db.S.cache.SetLocal(qstring, false)
+	return db.st.Remove(db.ProfilePath(qstring, "profile.json"))
+}
+
+// db_status translates DB errors into HTTP status codes
+func db_status(err error) int {
+	switch {
+	case os.IsNotExist(err):    return http.StatusNotFound
+	case err == err_mac_exists: return http.StatusConflict
+	case err == err_mac_moved:  return http.StatusConflict
+	case err == err_pf_exists:  return http.StatusConflict
+	case err == err_pf_query:   return http.StatusBadRequest
+	default:                    return http.StatusInternalServerError
+	}
+}
+
+func (a *Api) ListSwitches(ar *ApiRequest) *ApiRequest {
+	ret, err := a.S.db.ListDir(DB_IDS)
+	if os.IsNotExist(err) { ret, err = []string{}, nil }
+	if err != nil { return ar.Err(db_status(err), "listing switches failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+func (a *Api) ListPorts(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid switch", err.Error()) }
+
+	ret, err := a.S.db.ListDir(DB_IDS + "/" + id["@switch"])
+	if err != nil { return ar.Err(db_status(err), "listing ports failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+func (a *Api) ListMacs(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid port", err.Error()) }
+
+	ret, err := a.S.db.ListDir(a.S.db.PortPath(id))
+	if err != nil { return ar.Err(db_status(err), "listing MACs failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+func (a *Api) GetMac(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	ret, err := a.S.db.ReadMac(id)
+	if err != nil { return ar.Err(db_status(err), "reading identity failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+func (a *Api) AddMac(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	err = a.S.db.AddMac(id)
+	if err != nil { return ar.Err(db_status(err), "adding MAC failed", err.Error()) }
+	a.S.events.Notify(NewEvent("reauth", id, "MAC added"))
+
+	ar.status = http.StatusCreated
+	ar.out = id
+	return ar
+}
+
+func (a *Api) DelMac(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	err = a.S.db.DelMac(id)
+	if err != nil { return ar.Err(db_status(err), "deleting MAC failed", err.Error()) }
+	a.S.events.Notify(NewEvent("revoke", id, "MAC deleted"))
+
+	ar.out = id
+	return ar
+}
+
+// MoveMac moves a MAC to the @switch and/or @port given in input JSON
+func (a *Api) MoveMac(ar *ApiRequest) *ApiRequest {
+	S := a.S
+
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	input, ok := ar.in.(map[string]interface{})
+	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
+
+	// default to current location
+	in := make(map[string]interface{})
+	for _, k := range required {
+		if v, ok := input[k]; ok { in[k] = v } else { in[k] = id[k] }
+	}
+
+	to, err := S.NewIdentity(in)
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid target", err.Error()) }
+
+	err = S.db.MoveMac(id, to)
+	if err != nil { return ar.Err(db_status(err), "moving MAC failed", err.Error()) }
+	S.events.Notify(NewEvent("revoke", id, "MAC moved to " + S.db.Tag(to)))
+	S.events.Notify(NewEvent("reauth", to, "MAC moved from " + S.db.Tag(id)))
+
+	ar.out = to
+	return ar
+}
+
+func (a *Api) GetProfile(ar *ApiRequest) *ApiRequest {
+	qstring, err := a.S.db.ProfileQstring(ar.param["query"])
+	if err != nil { return ar.Err(db_status(err), err.Error(), nil) }
+
+	pf, err := a.S.db.ReadProfileAt(qstring)
+	if err != nil { return ar.Err(db_status(err), "reading profile failed", err.Error()) }
+
+	ar.out = pf
+	return ar
+}
+
+// PutProfile creates or replaces a local profile; with POST it only creates
+func (a *Api) PutProfile(ar *ApiRequest) *ApiRequest {
+	qstring, err := a.S.db.ProfileQstring(ar.param["query"])
+	if err != nil { return ar.Err(db_status(err), err.Error(), nil) }
+
+	input, ok := ar.in.(map[string]interface{})
+	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
+
+	create := ar.req.Method == "POST"
+	pf, err := a.S.db.WriteProfile(qstring, input, create)
+	switch {
+	case err == nil:
+		break
+	case err == err_pf_exists:
+		return ar.Err(db_status(err), err.Error(), nil)
+	case pf == nil:
+		if pe, ok := err.(ProfileError); ok {
+			return ar.Err(http.StatusBadRequest, "invalid profile", pe)
+		}
+		return ar.Err(http.StatusBadRequest, "invalid profile", err.Error())
+	default:
+		return ar.Err(db_status(err), "storing profile failed", err.Error())
+	}
+
+	a.S.events.Notify(NewEvent("reauth", nil, "profile changed: " + qstring))
+
+	if create { ar.status = http.StatusCreated }
+	ar.out = pf
+	return ar
+}
+
+func (a *Api) DelProfile(ar *ApiRequest) *ApiRequest {
+	qstring, err := a.S.db.ProfileQstring(ar.param["query"])
+	if err != nil { return ar.Err(db_status(err), err.Error(), nil) }
+
+	err = a.S.db.DelProfile(qstring)
+	if err != nil { return ar.Err(db_status(err), "deleting profile failed", err.Error()) }
+	a.S.events.Notify(NewEvent("reauth", nil, "profile deleted: " + qstring))
+
+	ar.out = qstring
+	return ar
+}
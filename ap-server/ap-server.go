@@ -5,6 +5,9 @@ import (
 	"flag"
 	"os"
 	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
 )
 
 const (
@@ -21,13 +24,43 @@ type Server struct {
 		me             string
 		//--
 		http           string
+		tls_cert       string
+		tls_key        string
+		tls_ca         string
+		tls_admin      string
+		admin_open     bool
 		db             string
+		store          string
+		migrate        string
 		auto           bool
 		fix            bool
+		oui            string
+		oui_mismatch   string
+		sig            string
+		https          bool
+		ca             string
+		pins           string
+		audit          string
+		audit_size     int64
+		metrics_hosts  string
+		compare        string
+		quarantine     string
+		mobility       string
 	}
 
-	api     *Api
-	db      *DB
+	api        *Api
+	db         *DB
+	oui        OUI
+	audit      *Audit
+	metrics    *Metrics
+	cache      *PfCache
+	hosts      *Hosts
+	events     *Events
+	registry   *Registry
+	http       http.Client
+	pins       map[string][]string // host -> SHA-256 SPKI pins
+	compare    map[string]string   // monotonic key -> comparator
+	quarantine map[error]bool      // Verify() errors leading to quarantine instead of deny
 }
 
 func main() {
@@ -42,13 +75,113 @@ func main() {
 	flag.IntVar(&S.opts.dbg, "dbg", 2, "debugging level")
 	flag.StringVar(&S.opts.me, "me", S.hostname, "my identity, e.g. name of this host")
 	flag.StringVar(&S.opts.http, "http", ":30000", "listen on given HTTP endpoint")
-	flag.StringVar(&S.opts.db, "db", "./db", "path to filesystem database")
-	flag.BoolVar(&S.opts.auto, "auto", true, "automatically add first seen MAC on a port")
+	flag.StringVar(&S.opts.tls_cert, "tls-cert", "", "serve HTTPS using given certificate (PEM)")
+	flag.StringVar(&S.opts.tls_key, "tls-key", "", "private key for -tls-cert (PEM)")
+	flag.StringVar(&S.opts.tls_ca, "tls-ca", "",
+		"require client certificates signed by given CA (PEM), and bind @switch to the certificate name")
+	flag.StringVar(&S.opts.tls_admin, "tls-admin", "",
+		"comma-separated client certificate names allowed to use the admin API (with -tls-ca)")
+	flag.BoolVar(&S.opts.admin_open, "admin-open", false,
+		"allow the admin API without client certificates (INSECURE, for testing only)")
+	flag.StringVar(&S.opts.db, "db", "./db", "path to database (directory or file, see -store)")
+	flag.StringVar(&S.opts.store, "store", "fs", "database backend: fs (directory tree) or bolt (embedded)")
+	flag.StringVar(&S.opts.migrate, "migrate", "",
+		"copy filesystem database from given directory into -db, then exit")
+	flag.BoolVar(&S.opts.auto, "auto", true, "automatically add new MACs on a port (up to the port security limit)")
+	flag.StringVar(&S.opts.mobility, "mobility", "deny",
+		"MAC seen on another port: deny, move (carry the identity over), off (treat as new)")
 	flag.BoolVar(&S.opts.fix, "fix", true, "fix missing keys in profiles (use old values)")
+	flag.StringVar(&S.opts.oui, "oui", "", "path to IEEE OUI registry (oui.csv or oui.txt)")
+	flag.StringVar(&S.opts.oui_mismatch, "oui-mismatch", "flag",
+		"what to do if manufacturer doesn't match the MAC vendor: flag, deny, quarantine")
+	flag.StringVar(&S.opts.sig, "sig", "auto",
+		"profile signatures: off, auto (required if manufacturer has trusted keys), require")
+	flag.BoolVar(&S.opts.https, "https", false, "require https:// for profile URLs")
+	flag.StringVar(&S.opts.ca, "ca", "", "path to CA bundle (PEM) for fetching profiles, instead of system CAs")
+	flag.StringVar(&S.opts.pins, "pins", "",
+		"path to JSON file with TLS pins: {\"host\": [\"<base64 SHA-256 of SPKI>\", ...]}")
+	flag.StringVar(&S.opts.audit, "audit", "auto",
+		"path to audit journal (auto: audit.jsonl in the -db directory, empty: disable)")
+	flag.Int64Var(&S.opts.audit_size, "audit-size", 100, "rotate the audit journal after given size (MiB)")
+	flag.StringVar(&S.opts.metrics_hosts, "metrics-hosts", "",
+		"comma-separated profile hosts to break down fetch metrics by, besides -pins hosts (others: \"other\")")
+	flag.StringVar(&S.opts.compare, "compare", "",
+		"comparators for monotonic keys, e.g. $build=date,*=lex (auto, lex, numeric, semver, date; default auto)")
+	flag.StringVar(&S.opts.quarantine, "quarantine", "",
+		"serve the quarantine profile instead of deny on given events: downgrade, unknown-mac, mac-moved\n" +
+		"(NB: MACs waiting for approval are not quarantined, see -auto)")
 	flag.Parse()
 	dbgSet(S.opts.dbg)
 
+	switch S.opts.oui_mismatch {
+	case "flag", "deny", "quarantine": break
+	default: die("main", "-oui-mismatch: invalid value: %s", S.opts.oui_mismatch)
+	}
+
+	switch S.opts.mobility {
+	case "move", "deny", "off": break
+	default: die("main", "-mobility: invalid value: %s", S.opts.mobility)
+	}
+
+	switch S.opts.sig {
+	case "off", "auto", "require": break
+	default: die("main", "-sig: invalid value: %s", S.opts.sig)
+	}
+
+	S.compare, err = parse_compare(S.opts.compare)
+	if err != nil { dieErr("-compare", err) }
+
+	S.quarantine, err = parse_quarantine(S.opts.quarantine)
+	if err != nil { dieErr("-quarantine", err) }
+
+	if len(S.opts.oui) > 0 {
+		S.oui, err = NewOUI(S.opts.oui)
+		if err != nil { dieErr("oui", err) }
+		dbg(1, "main", "loaded %d OUI prefixes from %s", len(S.oui), S.opts.oui)
+	}
+
+	if err := S.http_init(); err != nil { dieErr("http", err) }
+
+	S.metrics = NewMetrics()
+	for _, host := range strings.Split(S.opts.metrics_hosts, ",") {
+		if host = strings.TrimSpace(host); len(host) > 0 { S.metrics.AddHost(host) }
+	}
+	for host := range S.pins { S.metrics.AddHost(host) }
+	S.cache = NewPfCache()
+	S.hosts = NewHosts()
+	S.events = NewEvents()
+	S.registry = NewRegistry()
 	S.db = NewDB(S)
+	defer S.db.st.Close()
+
+	if S.opts.audit == "auto" { // NB: -db exists now
+		dir := S.opts.db
+		if S.opts.store == "bolt" { dir = filepath.Dir(dir) }
+		S.opts.audit = filepath.Join(dir, "audit.jsonl")
+	}
+	if len(S.opts.audit) > 0 {
+		S.audit, err = NewAudit(S.opts.audit, S.opts.audit_size << 20)
+		if err != nil { dieErr("audit", err) }
+	}
+
+	if len(S.opts.migrate) > 0 {
+		if err := S.db.Migrate(S.opts.migrate); err != nil { dieErr("migrate", err) }
+		return
+	}
+
+	if len(S.quarantine) > 0 || S.opts.oui_mismatch == "quarantine" {
+		if _, err := S.db.st.Stat(S.db.ProfilePath(PF_QUARANTINE, "profile.json")); err != nil {
+			dbg(0, "main", "quarantine enabled, but no quarantine profile set (see /v1/quarantine/profile)")
+		}
+	}
+
+	switch {
+	case S.opts.admin_open:
+		dbg(0, "main", "WARNING: admin API open to anyone who can connect (-admin-open)")
+	case len(S.opts.tls_ca) == 0 || len(S.opts.tls_admin) == 0:
+		dbg(0, "main", "admin API disabled: requires -tls-ca and -tls-admin")
+	}
+
 	S.api = NewApi(S)
 	if len(S.opts.http) > 0 {
 		S.wg.Add(1)
@@ -21,7 +21,14 @@ package main
 
 import (
 	// "fmt"
+	"errors"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+	"crypto/tls"
+	"crypto/x509"
 	"net/http"
 	"net/url"
 	"encoding/json"
@@ -53,6 +60,11 @@ type (
 	ApiHandler func(req *ApiRequest) *ApiRequest
 )
 
+var (
+	err_csrf_header = errors.New("admin changes require Content-Type: application/json or X-Requested-With")
+	err_csrf_origin = errors.New("cross-origin admin request denied")
+)
+
 func NewApi(S *Server) *Api {
     var a Api
 
@@ -60,14 +72,116 @@ func NewApi(S *Server) *Api {
 
 	a.rt = httprouter.New()
 	a.rt.POST("/v1/authorize", a.Wrap(a.Authorize))
+	a.rt.GET("/v1/events", a.Wrap(a.Events))
+	a.rt.POST("/v1/switches/:switch/register", a.Wrap(a.RegisterSwitch))
+	a.rt.POST("/v1/switches/:switch/report", a.Wrap(a.ReportSwitch))
+	a.rt.Handler("GET", "/metrics", S.metrics)
+
+	// admin: identities
+	a.rt.GET("/v1/identities", a.Wrap(a.Admin(a.ListSwitches)))
+	a.rt.GET("/v1/identities/:switch", a.Wrap(a.Admin(a.ListPorts)))
+	a.rt.GET("/v1/identities/:switch/:port", a.Wrap(a.Admin(a.ListMacs)))
+	a.rt.GET("/v1/identities/:switch/:port/:mac", a.Wrap(a.Admin(a.GetMac)))
+	a.rt.PUT("/v1/identities/:switch/:port/:mac", a.Wrap(a.Admin(a.AddMac)))
+	a.rt.DELETE("/v1/identities/:switch/:port/:mac", a.Wrap(a.Admin(a.DelMac)))
+	a.rt.POST("/v1/identities/:switch/:port/:mac/move", a.Wrap(a.Admin(a.MoveMac)))
+	a.rt.GET("/v1/identities/:switch/:port/:mac/history", a.Wrap(a.Admin(a.ListRevisions)))
+	a.rt.GET("/v1/identities/:switch/:port/:mac/history/:rev", a.Wrap(a.Admin(a.GetRevision)))
+	a.rt.GET("/v1/identities/:switch/:port/:mac/diff", a.Wrap(a.Admin(a.DiffRevisions)))
+	a.rt.POST("/v1/identities/:switch/:port/:mac/rollback", a.Wrap(a.Admin(a.Rollback)))
+	a.rt.POST("/v1/identities/:switch/:port/:mac/reauth", a.Wrap(a.Admin(a.Reauth)))
+	a.rt.GET("/v1/identities/:switch/:port/:mac/profile", a.Wrap(a.Admin(a.GetLayer)))
+	a.rt.PUT("/v1/identities/:switch/:port/:mac/profile", a.Wrap(a.Admin(a.PutLayer)))
+	a.rt.DELETE("/v1/identities/:switch/:port/:mac/profile", a.Wrap(a.Admin(a.DelLayer)))
+
+	// admin: port security
+	a.rt.GET("/v1/security/:switch", a.Wrap(a.Admin(a.GetSecurity)))
+	a.rt.PUT("/v1/security/:switch", a.Wrap(a.Admin(a.PutSecurity)))
+	a.rt.DELETE("/v1/security/:switch", a.Wrap(a.Admin(a.DelSecurity)))
+	a.rt.GET("/v1/security/:switch/:port", a.Wrap(a.Admin(a.GetSecurity)))
+	a.rt.PUT("/v1/security/:switch/:port", a.Wrap(a.Admin(a.PutSecurity)))
+	a.rt.DELETE("/v1/security/:switch/:port", a.Wrap(a.Admin(a.DelSecurity)))
+
+	// admin: local profiles
+	a.rt.GET("/v1/profiles/*query", a.Wrap(a.Admin(a.GetProfile)))
+	a.rt.POST("/v1/profiles/*query", a.Wrap(a.Admin(a.PutProfile)))
+	a.rt.PUT("/v1/profiles/*query", a.Wrap(a.Admin(a.PutProfile)))
+	a.rt.DELETE("/v1/profiles/*query", a.Wrap(a.Admin(a.DelProfile)))
+
+	// admin: site-wide profile
+	a.rt.GET("/v1/layers/:layer", a.Wrap(a.Admin(a.GetLayer)))
+	a.rt.PUT("/v1/layers/:layer", a.Wrap(a.Admin(a.PutLayer)))
+	a.rt.DELETE("/v1/layers/:layer", a.Wrap(a.Admin(a.DelLayer)))
+
+	// admin: device groups
+	a.rt.GET("/v1/groups", a.Wrap(a.Admin(a.ListGroups)))
+	a.rt.GET("/v1/groups/:group", a.Wrap(a.Admin(a.GetGroup)))
+	a.rt.PUT("/v1/groups/:group", a.Wrap(a.Admin(a.PutGroup)))
+	a.rt.DELETE("/v1/groups/:group", a.Wrap(a.Admin(a.DelGroup)))
+	a.rt.GET("/v1/groups/:group/profile", a.Wrap(a.Admin(a.GetLayer)))
+	a.rt.PUT("/v1/groups/:group/profile", a.Wrap(a.Admin(a.PutLayer)))
+	a.rt.DELETE("/v1/groups/:group/profile", a.Wrap(a.Admin(a.DelLayer)))
+
+	// admin: trusted keys
+	a.rt.GET("/v1/keys/:manufacturer", a.Wrap(a.Admin(a.ListKeys)))
+	a.rt.PUT("/v1/keys/:manufacturer/:name", a.Wrap(a.Admin(a.PutKey)))
+	a.rt.DELETE("/v1/keys/:manufacturer/:name", a.Wrap(a.Admin(a.DelKey)))
+
+	// admin: audit journal
+	a.rt.GET("/v1/audit", a.Wrap(a.Admin(a.GetAudit)))
+
+	// admin: switch registry
+	a.rt.GET("/v1/switches", a.Wrap(a.Admin(a.ListRegistry)))
+	a.rt.GET("/v1/switches/:switch", a.Wrap(a.Admin(a.GetRegistry)))
+
+	// admin: upstream profile servers
+	a.rt.GET("/v1/hosts", a.Wrap(a.Admin(a.ListHosts)))
+
+	// admin: quarantined devices
+	a.rt.GET("/v1/quarantine/profile", a.Wrap(a.Admin(a.GetQuarantine)))
+	a.rt.PUT("/v1/quarantine/profile", a.Wrap(a.Admin(a.PutQuarantine)))
+	a.rt.DELETE("/v1/quarantine/profile", a.Wrap(a.Admin(a.DelQuarantine)))
+	a.rt.GET("/v1/review", a.Wrap(a.Admin(a.ListReview)))
+	a.rt.DELETE("/v1/review/:switch/:port/:mac", a.Wrap(a.Admin(a.DelReview)))
+
+	// admin: MACs waiting for approval
+	a.rt.GET("/v1/pending", a.Wrap(a.Admin(a.ListPending)))
+	a.rt.POST("/v1/pending/:switch/:port/:mac/approve", a.Wrap(a.Admin(a.ApprovePending)))
+	a.rt.POST("/v1/pending/:switch/:port/:mac/reject", a.Wrap(a.Admin(a.RejectPending)))
+	a.rt.DELETE("/v1/pending/:switch/:port/:mac", a.Wrap(a.Admin(a.DelPending)))
+
+	// admin: web UI
+	a.rt.GET("/", a.Wrap(a.Admin(a.Dashboard)))
+	a.rt.GET("/ui", a.Wrap(a.Admin(a.Dashboard)))
 
     return &a
 }
 
 func (a *Api) ServeHttp(addr string) {
-	dbg(1, "api", "starting HTTP API at http://%s/", addr)
-	dbgErr(0, "api", http.ListenAndServe(addr, a.rt))
-	a.S.wg.Done()
+	S := a.S
+	defer S.wg.Done()
+
+	// plain HTTP?
+	if len(S.opts.tls_cert) == 0 {
+		dbg(1, "api", "starting HTTP API at http://%s/", addr)
+		dbgErr(0, "api", http.ListenAndServe(addr, a.rt))
+		return
+	}
+
+	// require client certificates?
+	tlsconf := &tls.Config{ MinVersion: tls.VersionTLS12 }
+	if len(S.opts.tls_ca) > 0 {
+		pem, err := ioutil.ReadFile(S.opts.tls_ca)
+		if err != nil { dieErr("api", err) }
+
+		tlsconf.ClientCAs = x509.NewCertPool()
+		if !tlsconf.ClientCAs.AppendCertsFromPEM(pem) { die("api", "%s: no certificates found", S.opts.tls_ca) }
+		tlsconf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	srv := &http.Server{ Addr: addr, Handler: a.rt, TLSConfig: tlsconf }
+	dbg(1, "api", "starting HTTPS API at https://%s/", addr)
+	dbgErr(0, "api", srv.ListenAndServeTLS(S.opts.tls_cert, S.opts.tls_key))
 }
 
 func (a *Api) Wrap(handler ApiHandler) httprouter.Handle {
@@ -112,6 +226,70 @@ func (a *Api) Wrap(handler ApiHandler) httprouter.Handle {
 	}
 }
 
+// Admin makes handler available only for client certificates listed in -tls-admin, or to anyone
+// with -admin-open
+func (a *Api) Admin(handler ApiHandler) ApiHandler {
+	return func(ar *ApiRequest) *ApiRequest {
+		if err := ar.CheckCSRF(); err != nil { return ar.Err(http.StatusForbidden, err.Error(), nil) }
+
+		names := ar.CertNames()
+		if names == nil {
+			if a.S.opts.admin_open { return handler(ar) }
+			return ar.Err(http.StatusForbidden, "admin access requires a client certificate listed in -tls-admin", nil)
+		}
+
+		for _, admin := range strings.Split(a.S.opts.tls_admin, ",") {
+			admin = strings.ToLower(strings.TrimSpace(admin))
+			for _, name := range names {
+				if len(admin) > 0 && name == admin { return handler(ar) }
+			}
+		}
+
+		return ar.Err(http.StatusForbidden, "admin access denied", names)
+	}
+}
+
+// CheckCSRF protects admin changes made from a web browser, which sends the client certificate
+// automatically: non-GET requests need a JSON content type or X-Requested-With (which cross-site
+// forms can't set), and the Origin - if any - must match the request host
+func (ar *ApiRequest) CheckCSRF() error {
+	if ar.req.Method == "GET" || ar.req.Method == "HEAD" { return nil }
+
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(ar.req.Header.Get("Content-Type"), ";")[0]))
+	if ct != "application/json" && len(ar.req.Header.Get("X-Requested-With")) == 0 {
+		return err_csrf_header
+	}
+
+	if origin := ar.req.Header.Get("Origin"); len(origin) > 0 {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, ar.req.Host) { return err_csrf_origin }
+	}
+
+	return nil
+}
+
+// CertNames returns the (lower-case) CN and DNS names of the verified client certificate,
+// or nil if the client didn't present one
+func (ar *ApiRequest) CertNames() []string {
+	if ar.req.TLS == nil || len(ar.req.TLS.VerifiedChains) == 0 { return nil }
+
+	cert := ar.req.TLS.VerifiedChains[0][0]
+	names := []string{ strings.ToLower(cert.Subject.CommonName) }
+	for _, name := range cert.DNSNames { names = append(names, strings.ToLower(name)) }
+	return names
+}
+
+// CertBound checks if name matches the client certificate (if any), returns the certificate names
+func (ar *ApiRequest) CertBound(name string) ([]string, bool) {
+	names := ar.CertNames()
+	if names == nil { return nil, true }
+
+	for _, n := range names {
+		if n == name { return names, true }
+	}
+	return names, false
+}
+
 func (ar *ApiRequest) Write() *ApiRequest {
 	if !ar.written {
 		ar.resp.Header().Set("Content-Type", "application/json")
@@ -138,6 +316,11 @@ func (ar *ApiRequest) Err(status int, message string, details interface{}) *ApiR
 func (a *Api) Authorize(ar *ApiRequest) *ApiRequest {
 	S := a.S
 
+	start := time.Now()
+	defer func() {
+		S.metrics.Observe("ap_authorize_duration_seconds", "", time.Since(start).Seconds())
+	}()
+
 	input, ok := ar.in.(map[string]interface{})
 	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
 
@@ -146,14 +329,66 @@ func (a *Api) Authorize(ar *ApiRequest) *ApiRequest {
 	if err == nil { err = id.CheckRequired() }
 	if err != nil { return ar.Err(http.StatusBadRequest, "invalid identity", err.Error()) }
 
+	claimed := id // NB: Verify() returns nil on error
+
+	// bind @switch to the client certificate
+	if names, ok := ar.CertBound(id["@switch"]); !ok {
+		dbg(1, "api", "%s: @switch does not match client certificate %v", S.db.Tag(id), names)
+		S.metrics.Inc("ap_authorize_total", labels("outcome", "denied"))
+		S.audit.Log("authorize", id, "deny", "", "@switch does not match client certificate")
+		return ar.Err(http.StatusForbidden, "@switch does not match client certificate", names)
+	}
+
 	// verify it's not a downgrade attack
 	id, err = S.db.Verify(id)
-	if err != nil { return ar.Err(http.StatusForbidden, err.Error(), nil) } // NB: permanent error
+
+	// unknown MAC and no auto-add? put it in the approval queue
+	if err == err_unknown_mac && !S.opts.auto { err = S.db.AddPending(claimed) }
+
+	// NB: waiting for approval takes precedence over quarantine, see parse_quarantine()
+	if err == err_pending { // NB: the switch should retry soon
+		S.metrics.Inc("ap_authorize_total", labels("outcome", "pending"))
+		S.audit.Log("authorize", claimed, "pending", "", err.Error())
+		ar.resp.Header().Set("Retry-After", strconv.Itoa(PENDING_RETRY))
+		return ar.Err(http.StatusAccepted, err.Error(), nil)
+	} else if err != nil && S.quarantine[err] { // contain the device, but keep it reachable
+		S.audit.Log("authorize", claimed, "quarantine", "", err.Error())
+
+		pf, err := S.db.Quarantine(claimed, err.Error())
+		if err != nil { // NB: will retry
+			S.metrics.Inc("ap_authorize_total", labels("outcome", "unavailable"))
+			return ar.Err(http.StatusServiceUnavailable, err.Error(), nil)
+		}
+
+		S.metrics.Inc("ap_authorize_total", labels("outcome", "quarantine"))
+		ar.out = pf
+		return ar
+	} else if err != nil { // NB: permanent error
+		switch err {
+		case err_downgrade:   S.metrics.Inc("ap_authorize_total", labels("outcome", "downgrade"))
+		case err_unknown_mac: S.metrics.Inc("ap_authorize_total", labels("outcome", "unknown_mac"))
+		case err_rejected:    S.metrics.Inc("ap_authorize_total", labels("outcome", "rejected"))
+		default:              S.metrics.Inc("ap_authorize_total", labels("outcome", "denied"))
+		}
+		S.audit.Log("authorize", claimed, "deny", "", err.Error())
+		return ar.Err(http.StatusForbidden, err.Error(), nil)
+	}
 
 	// authorize, fetch the traffic profile
 	pf, err := S.db.Authorize(id)
-	if err != nil { return ar.Err(http.StatusServiceUnavailable, err.Error(), nil) } // NB: will retry
-	
+	if err != nil { // NB: will retry
+		S.metrics.Inc("ap_authorize_total", labels("outcome", "unavailable"))
+		S.audit.Log("authorize", id, "error", "", err.Error())
+		return ar.Err(http.StatusServiceUnavailable, err.Error(), nil)
+	}
+
+	source, _ := pf["@source"].(string)
+	if _, ok := pf["@empty"]; ok { source = "empty" }
+	S.metrics.Inc("ap_authorize_total", labels("outcome", "ok"))
+	reason := ""
+	if key, ok := pf["@source_key"].(string); ok { reason = "signed by " + key }
+	S.audit.Log("authorize", id, "allow", source, reason)
+
 	ar.out = pf
 	return ar
 }
@@ -0,0 +1,99 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// admin_request runs the admin handler for a request without client certificate
+func admin_request(S *Server, method string) int {
+	a := &Api{ S: S }
+	ar := &ApiRequest{ api: a, status: http.StatusOK }
+	ar.req = httptest.NewRequest(method, "/v1/identities", nil)
+	ar.req.Header.Set("Content-Type", "application/json")
+	ar.resp = httptest.NewRecorder()
+
+	ok := func(ar *ApiRequest) *ApiRequest { ar.out = "ok"; return ar }
+	return a.Admin(ok)(ar).status
+}
+
+func TestAdminNoCert(t *testing.T) {
+	S := &Server{}
+	S.opts.tls_admin = "admin"
+
+	for _, method := range []string{ "GET", "PUT", "DELETE" } {
+		if status := admin_request(S, method); status != http.StatusForbidden {
+			t.Errorf("%s without client certificate: status %d, want 403", method, status)
+		}
+	}
+
+	S.opts.admin_open = true
+	if status := admin_request(S, "GET"); status != http.StatusOK {
+		t.Errorf("GET with -admin-open: status %d, want 200", status)
+	}
+}
+
+// authorize_request runs the Authorize handler for given identity
+func authorize_request(S *Server, id map[string]interface{}) *ApiRequest {
+	a := &Api{ S: S }
+	ar := &ApiRequest{ api: a, status: http.StatusOK, in: id }
+	ar.req = httptest.NewRequest("POST", "/v1/authorize", nil)
+	ar.resp = httptest.NewRecorder()
+	return a.Authorize(ar)
+}
+
+func TestAuthorizePendingQuarantine(t *testing.T) {
+	S := &Server{}
+	S.opts.auto = false
+	st, err := NewFileStore(t.TempDir())
+	if err != nil { t.Fatal(err) }
+	S.db = &DB{ S: S, st: st }
+
+	S.quarantine, err = parse_quarantine("unknown-mac")
+	if err != nil { t.Fatal(err) }
+
+	id := map[string]interface{}{ "@switch": "sw1", "@port": "eth1", "@mac": "00:11:22:33:44:55" }
+
+	// waiting for approval takes precedence over quarantine
+	ar := authorize_request(S, id)
+	if ar.status != http.StatusAccepted { t.Errorf("pending: status %d, want 202", ar.status) }
+	if ar.resp.Header().Get("Retry-After") == "" { t.Errorf("pending: no Retry-After") }
+
+	// rejected MACs are denied
+	if err := S.db.Reject(Identity{ "@switch": "sw1", "@port": "eth1", "@mac": "00:11:22:33:44:55" }); err != nil {
+		t.Fatal(err)
+	}
+	if ar := authorize_request(S, id); ar.status != http.StatusForbidden {
+		t.Errorf("rejected: status %d, want 403", ar.status)
+	}
+
+	// unknown MACs that can't be auto-added are quarantined
+	S.opts.auto = true
+	id["@port"] = "eth2"
+	if err := S.db.AddMac(Identity{ "@switch": "sw1", "@port": "eth2", "@mac": "00:11:22:33:44:66" }); err != nil {
+		t.Fatal(err) // NB: the port limit is 1 MAC by default
+	}
+	ar = authorize_request(S, id)
+	if ar.status != http.StatusOK { t.Errorf("quarantine: status %d, want 200", ar.status) }
+	if pf, ok := ar.out.(Profile); !ok || pf["@quarantine"] == nil { t.Errorf("quarantine: got %v", ar.out) }
+}
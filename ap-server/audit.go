@@ -0,0 +1,191 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_LIMIT = 1000      // default max. number of entries returned by the API
+	AUDIT_LIMIT_MAX = 10000 // hard limit on the number of entries returned by the API
+)
+
+// Audit is an append-only journal of authorization decisions, in JSON Lines format
+type Audit struct {
+	mutex    sync.Mutex
+	path     string
+	maxsize  int64
+	fh       *os.File
+	size     int64
+}
+
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`              // what happened, e.g. "auto-add"
+	Decision string    `json:"decision,omitempty"` // allow, deny or error
+	Source   string    `json:"source,omitempty"`   // profile source
+	Reason   string    `json:"reason,omitempty"`
+	Identity Identity  `json:"identity"`
+}
+
+// NewAudit opens the journal at path, rotating it after maxsize bytes
+func NewAudit(path string, maxsize int64) (*Audit, error) {
+	a := &Audit{ path: path, maxsize: maxsize }
+	return a, a.open()
+}
+
+func (a *Audit) open() error {
+	fh, err := os.OpenFile(a.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0640)
+	if err != nil { return err }
+
+	stat, err := fh.Stat()
+	if err != nil { fh.Close(); return err }
+
+	a.fh, a.size = fh, stat.Size()
+	return nil
+}
+
+// rotate renames the current journal to path.<UNIX time> and opens a new one
+func (a *Audit) rotate() error {
+	a.fh.Close()
+
+	err := os.Rename(a.path, fmt.Sprintf("%s.%d", a.path, time.Now().UnixNano()))
+	if err != nil { return err }
+
+	return a.open()
+}
+
+// Log appends an entry to the journal (if enabled)
+func (a *Audit) Log(event string, id Identity, decision string, source string, reason string) {
+	if a == nil { return }
+
+	e := AuditEntry{ time.Now().UTC(), event, decision, source, reason, make(Identity) }
+	for k, v := range id { e.Identity[k] = v }
+
+	jsonb, err := json.Marshal(&e)
+	if err != nil { dbgErr(0, "audit", err); return }
+	jsonb = append(jsonb, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.maxsize > 0 && a.size + int64(len(jsonb)) > a.maxsize {
+		if err := a.rotate(); err != nil { dbgErr(0, "audit", err); return }
+	}
+
+	n, err := a.fh.Write(jsonb)
+	a.size += int64(n)
+	if err != nil { dbgErr(0, "audit", err) }
+}
+
+// Query returns up to limit (at most AUDIT_LIMIT_MAX) most recent entries matching given switch,
+// MAC and time range
+func (a *Audit) Query(sw string, mac string, since time.Time, until time.Time, limit int) ([]AuditEntry, error) {
+	// rotated files first, then the current one
+	files, err := filepath.Glob(a.path + ".*")
+	if err != nil { return nil, err }
+	sort.Strings(files)
+	files = append(files, a.path)
+
+	if limit > AUDIT_LIMIT_MAX { limit = AUDIT_LIMIT_MAX }
+
+	ret := []AuditEntry{}
+	for _, file := range files {
+		// rotated before since? NB: the suffix is the rotation time
+		if file != a.path {
+			ns, err := strconv.ParseInt(file[len(a.path)+1:], 10, 64)
+			if err == nil && time.Unix(0, ns).Before(since) { continue }
+		}
+
+		fh, err := os.Open(file)
+		if os.IsNotExist(err) { continue }
+		if err != nil { return nil, err }
+
+		sc := bufio.NewScanner(fh)
+		sc.Buffer(nil, 1 << 20)
+		for sc.Scan() {
+			var e AuditEntry
+			if json.Unmarshal(sc.Bytes(), &e) != nil { continue }
+
+			switch {
+			case len(sw) > 0 && e.Identity["@switch"] != sw: continue
+			case len(mac) > 0 && e.Identity["@mac"] != mac:  continue
+			case e.Time.Before(since):                       continue
+			case !until.IsZero() && e.Time.After(until):      continue
+			}
+
+			ret = append(ret, e)
+			if len(ret) > limit { ret = ret[1:] }
+		}
+
+		err = sc.Err()
+		fh.Close()
+		if err != nil { return nil, err }
+	}
+
+	return ret, nil
+}
+
+// parse_time accepts RFC3339 or UNIX timestamps
+func parse_time(val string) (time.Time, error) {
+	if len(val) == 0 { return time.Time{}, nil }
+	if sec, err := strconv.ParseInt(val, 10, 64); err == nil { return time.Unix(sec, 0), nil }
+	return time.Parse(time.RFC3339, val)
+}
+
+// GetAudit queries the journal, e.g. ?switch=sw1&mac=...&since=...&until=...&limit=100
+//
+// Returns the last limit matching entries, up to AUDIT_LIMIT_MAX.
+func (a *Api) GetAudit(ar *ApiRequest) *ApiRequest {
+	if a.S.audit == nil { return ar.Err(http.StatusNotFound, "audit journal disabled", nil) }
+
+	since, err := parse_time(ar.query.Get("since"))
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid since", err.Error()) }
+
+	until, err := parse_time(ar.query.Get("until"))
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid until", err.Error()) }
+
+	limit := AUDIT_LIMIT
+	if v := ar.query.Get("limit"); len(v) > 0 {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 { return ar.Err(http.StatusBadRequest, "invalid limit", nil) }
+		if limit > AUDIT_LIMIT_MAX { limit = AUDIT_LIMIT_MAX }
+	}
+
+	id, err := a.S.NewIdentity(map[string]interface{}{
+		"@switch": ar.query.Get("switch"), "@mac": ar.query.Get("mac") })
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid query", err.Error()) }
+
+	ret, err := a.S.audit.Query(id["@switch"], id["@mac"], since, until, limit)
+	if err != nil { return ar.Err(http.StatusInternalServerError, "reading audit journal failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
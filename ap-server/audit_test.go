@@ -0,0 +1,54 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestAuditQuery(t *testing.T) {
+	path := t.TempDir() + "/audit.jsonl"
+	old := time.Now().Add(-time.Hour)
+
+	// a journal rotated an hour ago, with more entries than the hard limit
+	var b bytes.Buffer
+	for i := 0; i < AUDIT_LIMIT_MAX + 5; i++ {
+		fmt.Fprintf(&b, `{"time": %q, "event": "old", "identity": {}}` + "\n", old.Format(time.RFC3339))
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf("%s.%d", path, old.UnixNano()), b.Bytes(), 0640); err != nil { t.Fatal(err) }
+
+	a, err := NewAudit(path, 1 << 30)
+	if err != nil { t.Fatal(err) }
+	a.Log("new", Identity{ "@switch": "sw1" }, "", "", "")
+
+	ret, err := a.Query("", "", time.Time{}, time.Time{}, 1 << 30)
+	if err != nil { t.Fatal(err) }
+	if len(ret) != AUDIT_LIMIT_MAX { t.Errorf("no since: got %d entries, want %d", len(ret), AUDIT_LIMIT_MAX) }
+	if ret[len(ret)-1].Event != "new" { t.Errorf("no since: last entry %s, want new", ret[len(ret)-1].Event) }
+
+	ret, err = a.Query("", "", old.Add(time.Minute), time.Time{}, 10)
+	if err != nil { t.Fatal(err) }
+	if len(ret) != 1 || ret[0].Event != "new" { t.Errorf("since: got %v", ret) }
+}
@@ -0,0 +1,272 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PF_CACHE_MAX = 10000 // max. entries in the profile cache
+)
+
+// PfCache keeps fetched profiles in memory, by source URL
+//
+// Concurrent fetches of the same URL are coalesced: only the first caller hits the network,
+// the others wait for its result. The source URL is given by the device, so the number of
+// entries is bounded: see evict().
+//
+// It also keeps the qstrings of local profiles, so that lookups of fetched profiles don't need
+// to read the store first (NB: local profiles must be changed through the API, see SetLocal()).
+type PfCache struct {
+	mutex   sync.Mutex
+	entries map[string]*PfEntry
+	local   map[string]bool // qstring -> has a local profile
+}
+
+type PfEntry struct {
+	done     chan struct{} // closed when the fetch is complete
+	err      error         // fetch error
+	status   int           // HTTP status (200 or 404)
+	pf       Profile       // the profile, if status is 200 (NB: read-only)
+	etag     string        // ETag header, for conditional GETs
+	lastmod  string        // Last-Modified header, for conditional GETs
+	fetched  time.Time
+	expires  time.Time
+	used     time.Time     // last lookup (NB: guarded by PfCache.mutex)
+}
+
+func NewPfCache() *PfCache {
+	return &PfCache{ entries: make(map[string]*PfEntry), local: make(map[string]bool) }
+}
+
+// IsLocal returns true if qstring is known to have a local profile
+func (c *PfCache) IsLocal(qstring string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.local[qstring]
+}
+
+// SetLocal records whether qstring has a local profile
+//
+// NB: only local profiles are kept, as the number of qstrings depends on the devices
+func (c *PfCache) SetLocal(qstring string, local bool) {
+	c.mutex.Lock()
+	if local { c.local[qstring] = true } else { delete(c.local, qstring) }
+	c.mutex.Unlock()
+}
+
+// Peek returns the complete entry for src (if any), and whether it's still fresh
+func (c *PfCache) Peek(src string) (*PfEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[src]
+	if !ok { return nil, false }
+
+	select {
+	case <-e.done:
+		e.used = time.Now()
+		return e, time.Now().Before(e.expires)
+	default:
+		return nil, false // in flight
+	}
+}
+
+// Fetch returns a fresh entry for src, calling fetch if needed (with the previous entry, if any)
+func (c *PfCache) Fetch(src string, fetch func(old *PfEntry) *PfEntry) *PfEntry {
+	c.mutex.Lock()
+	old, ok := c.entries[src]
+	if ok {
+		select {
+		case <-old.done:
+			old.used = time.Now()
+			if time.Now().Before(old.expires) { c.mutex.Unlock(); return old }
+		default: // in flight, wait for it
+			c.mutex.Unlock()
+			<-old.done
+			return old
+		}
+	}
+
+	// we're the first one
+	if !ok && len(c.entries) >= PF_CACHE_MAX { c.evict() }
+	e := &PfEntry{ done: make(chan struct{}), used: time.Now() }
+	c.entries[src] = e
+	c.mutex.Unlock()
+
+	// fetch it
+	ret := fetch(old)
+
+	c.mutex.Lock()
+	e.err, e.status, e.pf = ret.err, ret.status, ret.pf
+	e.etag, e.lastmod, e.fetched, e.expires = ret.etag, ret.lastmod, ret.fetched, ret.expires
+	if e.err != nil {
+		if old != nil { c.entries[src] = old } else { delete(c.entries, src) } // NB: will retry
+	}
+	close(e.done)
+	c.mutex.Unlock()
+
+	return e
+}
+
+// evict drops entries expired for longer than PF_CACHE, then the least recently used ones,
+// down to 90% of PF_CACHE_MAX
+//
+// NB: c.mutex must be held
+func (c *PfCache) evict() {
+	now := time.Now()
+	done := []string{}
+
+	for src, e := range c.entries {
+		select {
+		case <-e.done:
+			if now.Sub(e.expires) > PF_CACHE * time.Second {
+				delete(c.entries, src)
+			} else {
+				done = append(done, src)
+			}
+		default: // in flight, keep
+		}
+	}
+
+	drop := len(c.entries) - PF_CACHE_MAX * 9 / 10
+	if drop <= 0 { return }
+	if drop > len(done) { drop = len(done) }
+
+	sort.Slice(done, func(i, j int) bool { return c.entries[done[i]].used.Before(c.entries[done[j]].used) })
+	for _, src := range done[:drop] { delete(c.entries, src) }
+
+	dbg(2, "cache", "evicted %d least recently used profiles", drop)
+}
+
+// Profile returns a copy of the entry profile
+func (e *PfEntry) Profile() Profile {
+	pf := make(Profile)
+	for k, v := range e.pf { pf[k] = v }
+	return pf
+}
+
+// cache_expires computes the expiry time given the HTTP response headers
+func cache_expires(hdr http.Header, now time.Time) time.Time {
+	for _, d := range strings.Split(hdr.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-cache", d == "no-store":
+			return now // always revalidate
+		case strings.HasPrefix(d, "max-age="):
+			if sec, err := strconv.ParseInt(d[8:], 10, 64); err == nil {
+				return now.Add(time.Duration(sec) * time.Second)
+			}
+		}
+	}
+
+	if exp, err := http.ParseTime(hdr.Get("Expires")); err == nil { return exp }
+
+	return now.Add(PF_CACHE * time.Second)
+}
+
+// Fetch downloads, verifies and stores the profile at qstring from src
+func (db *DB) Fetch(id Identity, manufacturer string, qstring string, src string, old *PfEntry) *PfEntry {
+	return db.fetch(id, manufacturer, qstring, src, old, func(pfbytes []byte) (Profile, error) {
+		in := make(map[string]interface{})
+		if err := json.Unmarshal(pfbytes, &in); err != nil { return nil, fmt.Errorf("JSON error: %s", err) }
+		return db.S.NewProfile(in, src)
+	})
+}
+
+// fetch implements Fetch, using parse to translate the (signed) file into a profile
+func (db *DB) fetch(id Identity, manufacturer string, qstring string, src string, old *PfEntry,
+	parse func(pfbytes []byte) (Profile, error)) *PfEntry {
+	tag := "db: " + db.Tag(id)
+	e := &PfEntry{}
+
+	// conditional GET?
+	var etag, lastmod string
+	if old != nil { etag, lastmod = old.etag, old.lastmod }
+
+	pfbytes, status, hdr, err := db.S.http_get_cond(src, etag, lastmod)
+	now := time.Now()
+	switch {
+	case err != nil:
+		e.err = err
+		return e
+	case status == http.StatusNotModified && old != nil:
+		dbg(3, tag, "profile not modified at %s", src)
+		*e = *old
+		e.done, e.fetched, e.expires = nil, now, cache_expires(hdr, now)
+		if e.pf != nil {
+			e.pf = e.Profile()
+			e.pf["@source_fetched"], e.pf["@source_expires"] = now.Unix(), e.expires.Unix()
+		}
+		return e
+	case status == http.StatusNotFound:
+		e.status, e.fetched, e.expires = status, now, cache_expires(hdr, now)
+		return e
+	case status != http.StatusOK:
+		e.err = fmt.Errorf("HTTP status %d", status)
+		return e
+	}
+
+	// verify the signature
+	key, err := db.VerifySig(manufacturer, src, pfbytes)
+	if err != nil {
+		dbg(2, tag, "profile from %s rejected: %s", src, err)
+		db.S.audit.Log("profile-rejected", id, "", src, err.Error())
+		e.err = err
+		return e
+	}
+
+	// parse, verify & ammend
+	pf, err := parse(pfbytes)
+	if err != nil {
+		dbg(2, tag, "profile from %s rejected: %s", src, err)
+		db.S.audit.Log("profile-rejected", id, "", src, err.Error())
+
+		// quarantine for review by the administrator
+		err2 := db.st.Write(db.ProfilePath(qstring, "quarantine.json"), pfbytes)
+		if err2 != nil { dbg(2, tag, "storing quarantined profile failed: %s", err2) }
+
+		e.err = err
+		return e
+	}
+
+	e.status, e.pf, e.fetched, e.expires = status, pf, now, cache_expires(hdr, now)
+	e.etag, e.lastmod = hdr.Get("ETag"), hdr.Get("Last-Modified")
+
+	if len(key) > 0 { pf["@source_key"] = key }
+	pf["@source_fetched"], pf["@source_expires"] = now.Unix(), e.expires.Unix()
+
+	// write to disk
+	jsonb, err := pf.JSON()
+	if err == nil { err = db.st.Write(db.ProfilePath(qstring, "profile.json"), jsonb) }
+	if err != nil { dbg(2, tag, "storing profile failed: %s", err) }
+
+	dbg(3, tag, "fetched new profile from %s", src)
+	db.S.audit.Log("profile-fetched", id, "", src, "")
+	return e
+}
@@ -0,0 +1,197 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comparator returns -1, 0 or 1 if a is smaller, equal or bigger than b
+type Comparator func(a string, b string) (int, error)
+
+// comparators for monotonic ($) identity keys, see -compare
+var comparators = map[string]Comparator{
+	"auto":    cmp_auto,
+	"lex":     cmp_lex,
+	"numeric": cmp_numeric,
+	"semver":  cmp_semver,
+	"date":    cmp_date,
+}
+
+// parse_compare parses the -compare option, e.g. "$version=semver,$build=date,*=lex"
+//
+// Keys not given use the "*" comparator, which defaults to auto.
+func parse_compare(opt string) (map[string]string, error) {
+	ret := map[string]string{ "*": "auto" }
+	for _, kv := range strings.Split(opt, ",") {
+		kv = strings.TrimSpace(kv)
+		if len(kv) == 0 { continue }
+
+		eq := strings.IndexByte(kv, '=')
+		if eq < 0 { return nil, fmt.Errorf("%s: expected key=comparator", kv) }
+		key, kind := kv[:eq], kv[eq+1:]
+
+		if key != "*" && (len(key) < 2 || key[0] != '$') {
+			return nil, fmt.Errorf("%s: not a monotonic key", key)
+		}
+		if _, ok := comparators[kind]; !ok {
+			return nil, fmt.Errorf("%s: invalid comparator: %s", key, kind)
+		}
+
+		ret[key] = kind
+	}
+	return ret, nil
+}
+
+// Compare compares two values of monotonic key k, returns the comparator name too
+func (S *Server) Compare(k string, a string, b string) (int, string, error) {
+	kind, ok := S.compare[k]
+	if !ok { kind = S.compare["*"] }
+
+	ret, err := comparators[kind](a, b)
+	return ret, kind, err
+}
+
+func cmp_int(a int64, b int64) int {
+	switch {
+	case a < b: return -1
+	case a > b: return 1
+	default:    return 0
+	}
+}
+
+// cmp_auto compares Semantic Versions, or strings (see cmp_lex) if any value is not a version
+func cmp_auto(a string, b string) (int, error) {
+	if c, err := cmp_semver(a, b); err == nil { return c, nil }
+	return cmp_lex(a, b)
+}
+
+// cmp_lex compares strings byte by byte, e.g. "1.9" > "1.10"
+func cmp_lex(a string, b string) (int, error) {
+	return strings.Compare(a, b), nil
+}
+
+// cmp_numeric compares dotted numbers, e.g. "1.10" > "1.9", "1.2" == "1.2.0"
+func cmp_numeric(a string, b string) (int, error) {
+	an, err := parse_dotted(a)
+	if err != nil { return 0, err }
+	bn, err := parse_dotted(b)
+	if err != nil { return 0, err }
+
+	for i := 0; i < len(an) || i < len(bn); i++ {
+		var x, y int64
+		if i < len(an) { x = an[i] }
+		if i < len(bn) { y = bn[i] }
+		if c := cmp_int(x, y); c != 0 { return c, nil }
+	}
+	return 0, nil
+}
+
+func parse_dotted(val string) ([]int64, error) {
+	var ret []int64
+	for _, s := range strings.Split(val, ".") {
+		n, err := strconv.ParseUint(s, 10, 63)
+		if err != nil { return nil, fmt.Errorf("'%s': not a dotted number", val) }
+		ret = append(ret, int64(n))
+	}
+	return ret, nil
+}
+
+// cmp_semver compares Semantic Versions (v2.0.0), e.g. "1.0.0-rc.1" < "1.0.0" < "v1.0.1+build5"
+//
+// A leading "v" is ignored, and missing minor or patch numbers are treated as 0.
+func cmp_semver(a string, b string) (int, error) {
+	acore, apre, err := parse_semver(a)
+	if err != nil { return 0, err }
+	bcore, bpre, err := parse_semver(b)
+	if err != nil { return 0, err }
+
+	if c, _ := cmp_numeric(acore, bcore); c != 0 { return c, nil }
+
+	// a pre-release version is smaller than the release
+	switch {
+	case apre == bpre:  return 0, nil
+	case len(apre) == 0: return 1, nil
+	case len(bpre) == 0: return -1, nil
+	}
+
+	// compare pre-release identifiers one by one
+	ai, bi := strings.Split(apre, "."), strings.Split(bpre, ".")
+	for i := 0; i < len(ai) && i < len(bi); i++ {
+		an, aerr := strconv.ParseUint(ai[i], 10, 63)
+		bn, berr := strconv.ParseUint(bi[i], 10, 63)
+		switch {
+		case aerr == nil && berr == nil:
+			if c := cmp_int(int64(an), int64(bn)); c != 0 { return c, nil }
+		case aerr == nil: return -1, nil // numeric < alphanumeric
+		case berr == nil: return 1, nil
+		default:
+			if c := strings.Compare(ai[i], bi[i]); c != 0 { return c, nil }
+		}
+	}
+	return cmp_int(int64(len(ai)), int64(len(bi))), nil
+}
+
+// parse_semver returns the MAJOR.MINOR.PATCH core and the pre-release part
+func parse_semver(val string) (string, string, error) {
+	s := strings.TrimPrefix(val, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 { s = s[:i] } // build metadata: ignore
+
+	core, pre, has_pre := s, "", false
+	if i := strings.IndexByte(s, '-'); i >= 0 { core, pre, has_pre = s[:i], s[i+1:], true }
+
+	n, err := parse_dotted(core)
+	if err != nil || len(n) > 3 { return "", "", fmt.Errorf("'%s': not a semantic version", val) }
+	if has_pre {
+		for _, id := range strings.Split(pre, ".") {
+			if len(id) == 0 { return "", "", fmt.Errorf("'%s': not a semantic version", val) }
+		}
+	}
+
+	return core, pre, nil
+}
+
+// date formats accepted by cmp_date
+var cmp_date_formats = []string{ time.RFC3339, "2006-01-02T15:04:05", "2006-01-02", "20060102" }
+
+// cmp_date compares dates, in one of cmp_date_formats or as UNIX timestamps
+func cmp_date(a string, b string) (int, error) {
+	at, err := parse_date(a)
+	if err != nil { return 0, err }
+	bt, err := parse_date(b)
+	if err != nil { return 0, err }
+
+	switch {
+	case at.Before(bt): return -1, nil
+	case at.After(bt):  return 1, nil
+	default:            return 0, nil
+	}
+}
+
+func parse_date(val string) (time.Time, error) {
+	for _, f := range cmp_date_formats {
+		if t, err := time.Parse(f, val); err == nil { return t, nil }
+	}
+	if sec, err := strconv.ParseInt(val, 10, 64); err == nil { return time.Unix(sec, 0), nil }
+	return time.Time{}, fmt.Errorf("'%s': not a date", val)
+}
@@ -0,0 +1,100 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestComparators(t *testing.T) {
+	tests := []struct {
+		kind string
+		a, b string
+		want int
+		err  bool
+	}{
+		{ "auto", "1.9", "1.10", -1, false },
+		{ "auto", "v2.0.0-rc.1", "2.0.0", -1, false },
+		{ "auto", "1.9/b2", "1.10", 1, false }, // falls back to lex
+		{ "auto", "r9", "r10", 1, false },
+
+		{ "lex", "1.9", "1.10", 1, false },
+		{ "lex", "abc", "abc", 0, false },
+
+		{ "numeric", "1.10", "1.9", 1, false },
+		{ "numeric", "1.2", "1.2.0", 0, false },
+		{ "numeric", "2", "10", -1, false },
+		{ "numeric", "1.x", "1.0", 0, true },
+
+		{ "semver", "1.0.0-rc.1", "1.0.0", -1, false },
+		{ "semver", "v1.0.1+build5", "1.0.0", 1, false },
+		{ "semver", "1.0.0+a", "1.0.0+b", 0, false },
+		{ "semver", "1.0.0-alpha", "1.0.0-alpha.1", -1, false },
+		{ "semver", "1.0.0-alpha.1", "1.0.0-alpha.beta", -1, false },
+		{ "semver", "1.0.0-beta.11", "1.0.0-beta.2", 1, false },
+		{ "semver", "1.2", "1.2.0", 0, false },
+		{ "semver", "1.2.3.4", "1.2.3", 0, true },
+		{ "semver", "1.0.0-", "1.0.0", 0, true },
+
+		{ "date", "2020-01-02", "2020-01-01T23:59:59Z", 1, false },
+		{ "date", "20200101", "2020-01-01", 0, false },
+		{ "date", "1577836800", "2020-01-01", 0, false },
+		{ "date", "yesterday", "2020-01-01", 0, true },
+	}
+
+	for _, tt := range tests {
+		got, err := comparators[tt.kind](tt.a, tt.b)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%s(%q, %q): expected an error", tt.kind, tt.a, tt.b)
+		case !tt.err && err != nil:
+			t.Errorf("%s(%q, %q): %s", tt.kind, tt.a, tt.b, err)
+		case !tt.err && got != tt.want:
+			t.Errorf("%s(%q, %q) = %d, want %d", tt.kind, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseCompare(t *testing.T) {
+	S := &Server{}
+
+	var err error
+	S.compare, err = parse_compare("$version=semver, $build=date")
+	if err != nil { t.Fatal(err) }
+
+	if _, kind, _ := S.Compare("$version", "1", "2"); kind != "semver" { t.Errorf("$version: got %s", kind) }
+	if _, kind, _ := S.Compare("$other", "1", "2"); kind != "auto" { t.Errorf("$other: got %s", kind) }
+
+	for _, opt := range []string{ "version=semver", "$version=bogus", "$version" } {
+		if _, err := parse_compare(opt); err == nil { t.Errorf("%s: expected an error", opt) }
+	}
+}
+
+func TestCompareDefault(t *testing.T) {
+	S := &Server{}
+
+	var err error
+	S.compare, err = parse_compare("")
+	if err != nil { t.Fatal(err) }
+
+	c, kind, err := S.Compare("$version", "1.9", "1.10")
+	if err != nil { t.Fatal(err) }
+	if c != -1 { t.Errorf("%s: 1.9 vs 1.10: got %d, want -1", kind, c) }
+}
@@ -0,0 +1,292 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+)
+
+// Dashboard serves the web UI, which uses the admin API
+func (a *Api) Dashboard(ar *ApiRequest) *ApiRequest {
+	ar.resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ar.resp.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+	ar.resp.WriteHeader(http.StatusOK)
+	ar.resp.Write([]byte(dashboard_html))
+	ar.written = true
+	return ar
+}
+
+// Reauth asks the switch to re-authorize given MAC now
+func (a *Api) Reauth(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	a.S.events.Notify(NewEvent("reauth", id, "requested by the administrator"))
+	ar.out = id
+	return ar
+}
+
+const dashboard_html = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Autopolicy</title>
+<style>
+body { font: 14px sans-serif; margin: 0; color: #222; }
+header { background: #234; color: #fff; padding: 8px 16px; }
+header a { color: #cde; margin-right: 16px; cursor: pointer; }
+header a.on { color: #fff; font-weight: bold; }
+main { padding: 16px; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+pre { background: #f6f6f6; padding: 8px; margin: 0; max-width: 60em; overflow: auto; }
+button { margin-right: 4px; }
+textarea { width: 60em; height: 24em; font-family: monospace; }
+.stale, .deny, .rejected { color: #b00; }
+.online, .allow { color: #080; }
+.quarantine, .pending { color: #b60; }
+#msg { color: #b00; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<header>
+<b>Autopolicy</b> &nbsp;
+<a data-view="switches">Switches</a>
+<a data-view="identities">Identities</a>
+<a data-view="pending">Pending</a>
+<a data-view="review">Review</a>
+<a data-view="audit">Audit</a>
+<a data-view="profiles">Profiles</a>
+</header>
+<main>
+<div id="msg"></div>
+<div id="view"></div>
+</main>
+<script>
+"use strict";
+
+const $view = document.getElementById("view");
+const $msg = document.getElementById("msg");
+
+function esc(s) {
+	return String(s === undefined || s === null ? "" : s).replace(/[&<>"']/g,
+		c => ({ "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" })[c]);
+}
+
+function path(...parts) { return parts.map(encodeURIComponent).join("/"); }
+
+async function api(method, url, body) {
+	const opts = { method: method, headers: { "X-Requested-With": "XMLHttpRequest" } };
+	if (body !== undefined) {
+		opts.headers["Content-Type"] = "application/json";
+		opts.body = JSON.stringify(body);
+	}
+
+	const resp = await fetch(url, opts);
+	const out = await resp.json();
+	if (!resp.ok) {
+		const e = out && out.error ? out.error : {};
+		throw new Error(e.message + (e.details ? ": " + JSON.stringify(e.details) : ""));
+	}
+	return out;
+}
+
+function table(cols, rows) {
+	let h = "<table><tr>" + cols.map(c => "<th>" + esc(c) + "</th>").join("") + "</tr>";
+	for (const r of rows) h += "<tr>" + r.map(c => "<td>" + c + "</td>").join("") + "</tr>";
+	return h + "</table>";
+}
+
+function btn(label, action, args) {
+	return "<button data-action=\"" + action + "\" data-args=\"" + esc(JSON.stringify(args)) + "\">" +
+		esc(label) + "</button>";
+}
+
+function json(v) { return "<pre>" + esc(JSON.stringify(v, null, 2)) + "</pre>"; }
+
+function since(t) { return t ? esc(new Date(t).toLocaleString()) : ""; }
+
+// views
+
+const views = {
+	async switches() {
+		const sws = await api("GET", "/v1/switches?states=1");
+		let h = "<h2>Switches</h2>" + table(["switch", "status", "version", "address", "last seen"],
+			sws.map(s => [esc(s.name), "<span class=\"" + esc(s.status) + "\">" + esc(s.status) + "</span>",
+				esc(s.version), esc(s.addr), since(s.last_seen)]));
+
+		for (const s of sws) {
+			h += "<h3>" + esc(s.name) + "</h3>" + table(
+				["port", "MAC", "state", "IP", "since", "profile", ""],
+				(s.states || []).map(st => [esc(st.port), esc(st.mac), esc(st.state), esc(st.lastip),
+					since(st.since), esc(st.source),
+					btn("re-auth", "reauth", [s.name, st.port, st.mac]) +
+					btn("identity", "identity", [s.name, st.port, st.mac]) +
+					btn("revoke", "revoke", [s.name, st.port, st.mac])]));
+		}
+		return h;
+	},
+
+	async identities(sw, port) {
+		let h = "<h2>Identities</h2>";
+		if (!sw) {
+			const sws = await api("GET", "/v1/identities");
+			return h + table(["switch"], sws.map(s => [btn(s, "identities", [s])]));
+		}
+		if (!port) {
+			const ports = await api("GET", "/v1/identities/" + path(sw));
+			return h + "<p>" + esc(sw) + "</p>" + table(["port"], ports.map(p => [btn(p, "identities", [sw, p])]));
+		}
+
+		const macs = await api("GET", "/v1/identities/" + path(sw, port));
+		h += "<p>" + esc(sw) + " / " + esc(port) + "</p>";
+		return h + table(["MAC", ""], macs.map(m => [esc(m),
+			btn("identity", "identity", [sw, port, m]) +
+			btn("re-auth", "reauth", [sw, port, m]) +
+			btn("revoke", "revoke", [sw, port, m])]));
+	},
+
+	async identity(sw, port, mac) {
+		const base = "/v1/identities/" + path(sw, port, mac);
+		const id = await api("GET", base);
+		const revs = await api("GET", base + "/history");
+
+		let h = "<h2>" + esc(sw) + " / " + esc(port) + " / " + esc(mac) + "</h2>" + json(id);
+		h += "<h3>History</h3>" + table(["revision", "time", ""], revs.slice().reverse().map(r => [
+			esc(r.rev), since(r.time),
+			btn("diff to current", "diff", [sw, port, mac, r.rev]) +
+			btn("roll back", "rollback", [sw, port, mac, r.rev])]));
+		return h;
+	},
+
+	async pending() {
+		const ps = await api("GET", "/v1/pending");
+		return "<h2>Waiting for approval</h2>" + table(["switch", "port", "MAC", "state", "last seen", "count", "identity", ""],
+			ps.map(p => { const i = p.identity, a = [i["@switch"], i["@port"], i["@mac"]]; return [
+				esc(a[0]), esc(a[1]), esc(a[2]), "<span class=\"" + esc(p.state) + "\">" + esc(p.state) + "</span>",
+				since(p.last), esc(p.count), json(i),
+				btn("approve", "approve", a) + btn("reject", "reject", a) + btn("forget", "forget", a)]; }));
+	},
+
+	async review() {
+		const rs = await api("GET", "/v1/review");
+		return "<h2>Quarantined devices</h2>" + table(["switch", "port", "MAC", "reason", "last", "count", ""],
+			rs.map(r => { const i = r.identity, a = [i["@switch"], i["@port"], i["@mac"]]; return [
+				esc(a[0]), esc(a[1]), esc(a[2]), esc(r.reason), since(r.last), esc(r.count),
+				btn("identity", "identity", a) + btn("dismiss", "dismiss", a)]; }));
+	},
+
+	async audit() {
+		const es = await api("GET", "/v1/audit?limit=100");
+		return "<h2>Recent events</h2>" + table(["time", "event", "decision", "device", "source", "reason"],
+			es.reverse().map(e => [since(e.time), esc(e.event),
+				"<span class=\"" + esc(e.decision) + "\">" + esc(e.decision) + "</span>",
+				esc([e.identity["@switch"], e.identity["@port"], e.identity["@mac"]].join(" / ")),
+				esc(e.source), esc(e.reason)]));
+	},
+
+	async profiles(query) {
+		query = query || "";
+		let pf = "";
+		if (query) {
+			try { pf = JSON.stringify(await api("GET", "/v1/profiles/" + query), null, 2); }
+			catch (e) { pf = "{\n  \"from_device\": {},\n  \"to_device\": {}\n}"; }
+		}
+
+		return "<h2>Local profiles</h2>" +
+			"<p>manufacturer/device/revision/version: <input id=\"query\" size=\"60\" value=\"" + esc(query) + "\"> " +
+			"<button data-action=\"profile-load\">load</button></p>" +
+			(query ? "<textarea id=\"profile\">" + esc(pf) + "</textarea><p>" +
+				"<button data-action=\"profile-save\">save</button>" +
+				"<button data-action=\"profile-delete\">delete</button></p>" : "");
+	},
+};
+
+// actions
+
+const actions = {
+	identities: (...a) => show("identities", a),
+	identity: (...a) => show("identity", a),
+
+	async reauth(sw, port, mac) { await api("POST", "/v1/identities/" + path(sw, port, mac) + "/reauth"); },
+	async revoke(sw, port, mac) {
+		if (!confirm("Revoke " + mac + " on " + sw + "/" + port + "? Its stored identity will be deleted.")) return;
+		await api("DELETE", "/v1/identities/" + path(sw, port, mac));
+		refresh();
+	},
+
+	async diff(sw, port, mac, rev) {
+		const d = await api("GET", "/v1/identities/" + path(sw, port, mac) + "/diff?from=" + encodeURIComponent(rev));
+		$msg.style.color = "#222";
+		$msg.textContent = "diff " + rev + " -> current:\n" + JSON.stringify(d, null, 2);
+	},
+	async rollback(sw, port, mac, rev) {
+		if (!confirm("Roll back the identity to revision " + rev + "?")) return;
+		await api("POST", "/v1/identities/" + path(sw, port, mac) + "/rollback", { rev: rev });
+		refresh();
+	},
+
+	async approve(sw, port, mac) { await api("POST", "/v1/pending/" + path(sw, port, mac) + "/approve"); refresh(); },
+	async reject(sw, port, mac) { await api("POST", "/v1/pending/" + path(sw, port, mac) + "/reject"); refresh(); },
+	async forget(sw, port, mac) { await api("DELETE", "/v1/pending/" + path(sw, port, mac)); refresh(); },
+	async dismiss(sw, port, mac) { await api("DELETE", "/v1/review/" + path(sw, port, mac)); refresh(); },
+
+	"profile-load": () => show("profiles", [document.getElementById("query").value.replace(/^\/+|\/+$/g, "")]),
+	async "profile-save"() {
+		const q = document.getElementById("query").value;
+		await api("PUT", "/v1/profiles/" + q, JSON.parse(document.getElementById("profile").value));
+		refresh();
+	},
+	async "profile-delete"() {
+		const q = document.getElementById("query").value;
+		if (!confirm("Delete local profile " + q + "?")) return;
+		await api("DELETE", "/v1/profiles/" + q);
+		show("profiles", []);
+	},
+};
+
+let current = ["switches", []];
+
+async function show(view, args) {
+	current = [view, args];
+	for (const a of document.querySelectorAll("header a")) a.className = a.dataset.view === view ? "on" : "";
+	$msg.textContent = "";
+	try { $view.innerHTML = await views[view](...args); }
+	catch (e) { $msg.style.color = ""; $msg.textContent = e.message; $view.innerHTML = ""; }
+}
+
+function refresh() { show(current[0], current[1]); }
+
+document.addEventListener("click", async ev => {
+	const t = ev.target;
+	if (t.dataset.view) return show(t.dataset.view, []);
+	if (!t.dataset.action) return;
+
+	try { await actions[t.dataset.action](...JSON.parse(t.dataset.args || "[]")); }
+	catch (e) { $msg.style.color = ""; $msg.textContent = e.message; }
+});
+
+show("switches", []);
+setInterval(() => { if (current[0] === "switches") refresh(); }, 10000);
+</script>
+</body>
+</html>
+`
@@ -22,50 +22,78 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-	"context"
 	"bytes"
 	"time"
 	"strings"
-	"io/ioutil"
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 )
 
 const (
 	DB_IDS = "identities"
 	DB_PFS = "profiles"
 
-	PF_PROTO = "http://"  // FIXME: use https://
-	PF_CACHE = 60 * 15    // cache profiles for 15 minutes
+	PF_QUARANTINE = "_quarantine" // NB: escape() never returns a leading '_'
 
-	HTTP_TIMEOUT = 10e9   // in nanoseconds
+	PF_CACHE = 60 * 15    // cache profiles for 15 minutes
 )
 
 var (
 	err_unknown_mac = errors.New("MAC address not authorized on that port")
 	err_mac_file = errors.New("DB error for that MAC: should be a directory")
 	err_downgrade = errors.New("identity downgrade detected")
-	err_http_200 = errors.New("HTTP status code != 200")
+	err_vendor = errors.New("manufacturer does not match the MAC vendor")
 
 	pf_query = [...]string{ "manufacturer", "device", "revision", "$version" }
 )
 
 type DB struct {
-	S *Server
+	S      *Server
+	st     Store
+	mutex  sync.Mutex // serializes identity changes
+	gcache GroupCache // parsed group definitions
+	macs   MacIndex   // MAC locations, see FindMac() (NB: nil if not loaded)
 }
 
 func NewDB(S *Server) *DB {
-	// change CWD to -db
-	if err := os.MkdirAll(S.opts.db, 0750); err != nil { dieErr("db", err) }
-	if err := os.Chdir(S.opts.db); err != nil { dieErr("db", err) }
+	st, err := NewStore(S.opts.store, S.opts.db)
+	if err != nil { dieErr("db", err) }
 
 	db := &DB{}
 	db.S = S
+	db.st = st
 
 	return db
 }
 
+// Migrate copies the whole database from src directory into the configured store
+func (db *DB) Migrate(src string) error {
+	fs, err := NewFileStore(src)
+	if err != nil { return err }
+
+	// NB: only the directories, skipping e.g. the audit journal
+	entries, err := fs.List("")
+	if err != nil { return err }
+
+	files := 0
+	for _, e := range entries {
+		if !e.IsDir { continue }
+
+		err = db.st.Mkdir(e.Name)
+		if err == nil {
+			var n int
+			n, err = CopyStore(db.st, fs, e.Name)
+			files += n
+		}
+		if err != nil { break }
+	}
+
+	dbg(1, "db", "migrated %d files from %s to %s:%s", files, src, db.S.opts.store, db.S.opts.db)
+	return err
+}
+
 func (db *DB) Tag(id Identity) string {
 	return fmt.Sprintf("%s/%s/%s", id["@switch"], id["@port"], id["@mac"])
 }
@@ -78,6 +106,10 @@ func (db *DB) PortPath(id Identity) string {
 	return fmt.Sprintf("%s/%s/%s", DB_IDS, id["@switch"], id["@port"])
 }
 
+func (db *DB) SwitchPath(id Identity) string {
+	return fmt.Sprintf("%s/%s", DB_IDS, id["@switch"])
+}
+
 func (db *DB) ProfileDir(qstring string) string {
 	return fmt.Sprintf("%s/%s", DB_PFS, qstring)
 }
@@ -95,8 +127,8 @@ func (db *DB) ProfileQuery(url string, qstring string) string {
 // First, it will check if we either haven't seen any identity for that device yet, or - if we had -
 // it will verify that the identity is not downgraded vs. what has already been seen.
 //
-// Second (TODO), it will supplement the identity with any additional keys set by the system
-// administrator (add.json, set.json, del.json)
+// Second, it will supplement the identity with any additional keys set by the system
+// administrator (add.json, set.json, del.json), see Supplement()
 //
 func (db *DB) Verify(id Identity) (Identity, error) {
 	// full path to MAC
@@ -105,34 +137,48 @@ func (db *DB) Verify(id Identity) (Identity, error) {
 	tag := db.Tag(id)
 	dbg(3, "db", "%s: veryfing id %#v", tag, id)
 
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	// is MAC authorized on that switch port?
-	checkpath: switch stat, err := os.Stat(path); {
+	checkpath: switch stat, err := db.st.Stat(path); {
 	case err == nil: // path exists, just make sure it's a directory
-		if !stat.IsDir() { return nil, err_mac_file }
+		if !stat.IsDir { return nil, err_mac_file }
 
-	case os.IsNotExist(err): // doesn't exist
-		// should we automatically add first MAC on that switch port?
-		if db.S.opts.auto {
-			switch files, err := ioutil.ReadDir(db.PortPath(id)); { // port dir exists?
-			case err == nil: // yes, but...
-				if len(files) == 0 { // empty? try to create the MAC dir
-					err = os.Mkdir(path, 0755)
-					if err != nil { return nil, err } // OS error?
-					dbg(4, "db", "%s: first MAC on existing port -> auto-add", tag)
-					break checkpath  // created, good to go!
-				}
+		// keep track of the MAC for aging
+		ps, err := db.ReadSecurity(id)
+		if err == nil && ps.Mode == "aging" { err = db.Seen(id) }
+		if err != nil { dbg(1, "db", "%s: port security: %s", tag, err) }
 
-			case os.IsNotExist(err): // doesn't exist, try to create MAC dir
-				err = os.MkdirAll(path, 0755)
-				if err != nil { return nil, err } // OS error?
-				dbg(4, "db", "%s: first MAC on non-existing port -> auto-add", tag)
-				break checkpath  // created, good to go!
+	case os.IsNotExist(err): // doesn't exist
+		// seen on another port?
+		from, err := db.Moved(id)
+		if err != nil { return nil, err }
 
-			default: return nil, err // OS error?
+		// should we automatically add the MAC on that switch port?
+		if db.S.opts.auto {
+			ps, err := db.ReadSecurity(id)
+			if err != nil { return nil, err } // NB: fail hard
+
+			switch err := db.AutoAdd(id, ps); {
+			case err == nil && from != nil: // keep the identity baseline
+				if err := db.CarryOver(from, id); err != nil { return nil, err }
+				break checkpath
+			case err == nil:
+				break checkpath // created, good to go!
+			case (err == err_port_limit || err == err_switch_limit) && ps.Violation == "quarantine":
+				db.S.audit.Log("port-security", id, "quarantine", "", err.Error())
+				id["@quarantine"] = err.Error()
+				return id, nil // NB: don't store the identity
+			case err == err_port_limit || err == err_switch_limit:
+				db.S.audit.Log("port-security", id, "deny", "", err.Error())
+			default:
+				return nil, err // OS error?
 			}
 		}
-		
+
 		// nah, block this MAC
+		db.S.audit.Log("unknown-mac", id, "deny", "", err_unknown_mac.Error())
 		return nil, err_unknown_mac
 		
 	default: return nil, err // OS error?
@@ -144,15 +190,14 @@ func (db *DB) Verify(id Identity) (Identity, error) {
 
 	// do we already have the identity file?
 	pathid := path + "/identity.json"
-	fh, err := os.Open(pathid)
+	jsonb, err := db.st.Read(pathid)
 	if err != nil {
 		switch {
 		case os.IsNotExist(err): break // first identity seen so far
 		default: return nil, err       // NB: fail hard (deny access on I/O error)
 		}
 	} else { // verify if no downgrade
-		defer fh.Close()
-		old, err := db.S.ReadIdentity(fh)
+		old, err := db.S.ReadIdentity(bytes.NewReader(jsonb))
 		if err != nil { return nil, err } // NB: fail hard (deny access on I/O error)
 
 		// go through all already stored identity keys
@@ -170,23 +215,36 @@ func (db *DB) Verify(id Identity) (Identity, error) {
 				} else {
 					dbg(2, "db", "%s: downgrade of '%s': old value '%s', now missing",
 						tag, k, oldval)
+					db.S.audit.Log("downgrade", id, "deny", "",
+						fmt.Sprintf("'%s': old value '%s', now missing", k, oldval))
 					return nil, err_downgrade
 				}
 			case oldval == newval: // value the same as already seen, OK!
 				delete(todo, k)
 				continue
-			case k[0] == '$': // allow update after lexicographical check
-				if newval < oldval {
-					dbg(2, "db", "%s: downgrade of '%s': old '%s' bigger than new '%s'",
-						tag, k, oldval, newval)
+			case k[0] == '$': // allow update after comparison, see -compare
+				c, kind, err := db.S.Compare(k, newval, oldval)
+				if err != nil { // NB: fail hard
+					dbg(2, "db", "%s: downgrade of '%s': %s comparison failed: %s",
+						tag, k, kind, err)
+					db.S.audit.Log("downgrade", id, "deny", "",
+						fmt.Sprintf("'%s': %s comparison failed: %s", k, kind, err))
+					return nil, err_downgrade
+				} else if c < 0 {
+					dbg(2, "db", "%s: downgrade of '%s': old '%s' bigger than new '%s' (%s)",
+						tag, k, oldval, newval, kind)
+					db.S.audit.Log("downgrade", id, "deny", "",
+						fmt.Sprintf("'%s': old '%s' bigger than new '%s' (%s)", k, oldval, newval, kind))
 					return nil, err_downgrade
 				} else {
-					dbg(2, "db", "%s: update of '%s': old '%s' smaller than new '%s'",
-						tag, k, oldval, newval)
+					dbg(2, "db", "%s: update of '%s': old '%s' smaller than new '%s' (%s)",
+						tag, k, oldval, newval, kind)
 				}
 			default: // key value changed, downgrade detected!
 				dbg(2, "db", "%s: downgrade of '%s': old '%s' vs. new '%s'",
 					tag, k, oldval, newval)
+				db.S.audit.Log("downgrade", id, "deny", "",
+					fmt.Sprintf("'%s': old '%s' vs. new '%s'", k, oldval, newval))
 				return nil, err_downgrade
 			}
 		}
@@ -195,29 +253,129 @@ func (db *DB) Verify(id Identity) (Identity, error) {
 	// should we store an updated identity file?
 	if len(todo) > 0 {
 		dbg(1, "db", "%s: writing new identity file", tag)
+		db.S.audit.Log("identity", id, "", "", "new identity keys stored")
 
-		jsonb, err := id.JSON()
-		if err == nil { err = ioutil.WriteFile(pathid, jsonb, 0640) }
+		err := db.WriteIdentity(id)
 		if err != nil { dbg(0, "db", "storing the identity failed: %s", err) }
 	}
 
-	// TODO: do we have any additional identity elements to add?
-	// e.g. read path/(../)add.json, use the OUI db
-	
+	// do we have any additional identity elements to add?
+	if err := db.Supplement(id); err != nil { return nil, err } // NB: fail hard
+
+	// use the OUI db
+	if db.S.oui != nil {
+		if err := db.Vendor(id); err != nil { return nil, err }
+	}
+
 	return id, nil
 }
 
-// Authorize fetches the traffic profile for given (verified) identity
-func (db *DB) Authorize(id Identity) (pf Profile, err error) {
+// Vendor adds the MAC vendor as @vendor, and checks it against the claimed manufacturer
+func (db *DB) Vendor(id Identity) error {
+	vendor, ok := db.S.oui.Lookup(id["@mac"])
+	if !ok { return nil }
+	id["@vendor"] = vendor
+
+	manufacturer, ok := id["manufacturer"]
+	if !ok || vendor_match(manufacturer, vendor) { return nil }
+
+	dbg(2, "db", "%s: manufacturer '%s' does not match MAC vendor '%s'",
+		db.Tag(id), manufacturer, vendor)
+	id["@vendor_mismatch"] = "true"
+
+	switch db.S.opts.oui_mismatch {
+	case "deny":
+		return err_vendor
+	case "quarantine":
+		id["@quarantine"] = err_vendor.Error()
+	}
+
+	return nil
+}
+
+// Supplement applies identity changes set by the system administrator
+//
+// The files are read from the switch, port and MAC directories - in that order, so that the more
+// specific level takes precedence. On each level, del.json is applied first (an array of keys
+// to remove), then add.json (keys added only if missing, or if added by a less specific add.json),
+// then set.json (keys overridden). Internal keys (starting with '@') can't be changed.
+//
+func (db *DB) Supplement(id Identity) error {
+	tag := db.Tag(id)
+	added := make(map[string]bool) // keys set by add.json so far
+
+	for _, dir := range []string{ db.SwitchPath(id), db.PortPath(id), db.MacPath(id) } {
+		// del.json
+		var del []string
+		switch jsonb, err := db.st.Read(dir + "/del.json"); {
+		case err == nil:
+			if err := json.Unmarshal(jsonb, &del); err != nil {
+				return fmt.Errorf("%s/del.json: %s", dir, err)
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+		for _, k := range del {
+			if len(k) == 0 || k[0] == '@' { continue }
+			dbg(4, "db", "%s: %s/del.json: deleting '%s'", tag, dir, k)
+			delete(id, k)
+			delete(added, k)
+		}
+
+		// add.json and set.json
+		for _, file := range []string{ "add.json", "set.json" } {
+			jsonb, err := db.st.Read(dir + "/" + file)
+			if os.IsNotExist(err) { continue }
+			if err != nil { return err }
+
+			sup, err := db.S.ReadIdentity(bytes.NewReader(jsonb))
+			if err != nil { return fmt.Errorf("%s/%s: %s", dir, file, err) }
+
+			for k, v := range sup {
+				if len(k) == 0 || k[0] == '@' { continue }
+				if _, ok := id[k]; ok && file == "add.json" && !added[k] { continue }
+				dbg(4, "db", "%s: %s/%s: setting '%s' to '%s'", tag, dir, file, k, v)
+				id[k] = v
+				added[k] = file == "add.json"
+			}
+		}
+	}
+
+	return nil
+}
+
+// Authorize fetches the traffic profile for given (verified) identity, and merges it with
+// the local profile layers, see Merge()
+func (db *DB) Authorize(id Identity) (Profile, error) {
+	// quarantined?
+	if reason, ok := id["@quarantine"]; ok {
+		return db.Quarantine(id, reason)
+	}
+
+	pf, err := db.BaseProfile(id)
+	if err != nil { return nil, err }
+
+	return db.Merge(id, pf)
+}
+
+// BaseProfile fetches the manufacturer (or MUD) profile for given identity
+func (db *DB) BaseProfile(id Identity) (pf Profile, err error) {
 	tag := "db: " + db.Tag(id)
 
+	// has a MUD URL? (RFC 8520)
+	if _, ok := id[ID_MUD]; ok {
+		pf, err = db.AuthorizeMud(id)
+		if err == nil { return pf, nil }
+		dbg(2, tag, "MUD failed, will try Autopolicy profiles: %s", err)
+	}
+
 	// TODO: use external API if requested
 
 	// get the URL and validate it
 	url, has_url := id["url"]
 	if has_url {
 		url = strings.TrimRight(url, "/")
-		if len(url) <= len(PF_PROTO) || url[:len(PF_PROTO)] != PF_PROTO {
+		if !db.S.http_url(url) {
 			dbg(3, tag, "invalid url in identity: %s", url)
 			has_url = false
 		}
@@ -226,11 +384,12 @@ func (db *DB) Authorize(id Identity) (pf Profile, err error) {
 	// build queries for decreasing level of detail
 	query := make([]string, len(pf_query))
 	read_from := ""
+	fresh := false
 	rebuild: for i := len(pf_query); i >= 0 && len(read_from) == 0; i-- {
 		// collect the query values
 		query = query[0:i]
 		for j := i - 1; j >= 0; j-- {
-			if v, ok := id[pf_query[j]]; ok && len(v) > 0 {
+			if v := db.QueryValue(id, j); len(v) > 0 {
 				query[j] = escape(v)
 			} else {
 				continue rebuild
@@ -240,73 +399,82 @@ func (db *DB) Authorize(id Identity) (pf Profile, err error) {
 		// use it
 		qstring := strings.Join(query, "/")
 		pfpath  := db.ProfilePath(qstring, "profile.json")
+		src     := db.ProfileQuery(url, qstring)
+
+		// is it in memory? NB: never overwrite local profiles
+		var entry *PfEntry
+		local := db.S.cache.IsLocal(qstring)
+		if has_url && !local {
+			var ok bool
+			if entry, ok = db.S.cache.Peek(src); ok {
+				db.S.metrics.Inc("ap_profile_cache_total", labels("result", "hit"))
+				if entry.status == http.StatusNotFound { continue }
+				return entry.Profile(), nil
+			}
+		}
 
-		// check if a recent copy is in the local db
-		stat, err := os.Stat(pfpath)
+		// check if a local profile or a recent copy is in the local db
+		stat, err := db.st.Stat(pfpath)
 		if err == nil {
 			read_from = pfpath // NB: will use it anyway if can't fetch
-			if time.Now().Unix() - stat.ModTime().Unix() < PF_CACHE { break }
-		} else {
-			// make sure the directory exists
-			os.MkdirAll(db.ProfileDir(qstring), 0755)
+
+			if !local && entry == nil { // NB: not seen yet
+				local = db.IsLocal(qstring)
+				if local { db.S.cache.SetLocal(qstring, true) }
+			}
+
+			if local || (entry == nil && time.Now().Unix() - stat.ModTime.Unix() < PF_CACHE) {
+				db.S.metrics.Inc("ap_profile_cache_total", labels("result", "hit"))
+				fresh = true
+				break
+			}
+			db.S.metrics.Inc("ap_profile_cache_total", labels("result", "stale"))
+		} else if has_url {
+			db.S.metrics.Inc("ap_profile_cache_total", labels("result", "miss"))
 		}
 
-		// try to fetch it & store on disk
+		// try to fetch it (or revalidate) & store on disk
 		if has_url {
-			// GET
-			src := db.ProfileQuery(url, qstring)
-			pfbytes, status, err := db.S.http_get(src)
-			if err != nil {
-				dbg(3, tag, "HTTP error: %s", err)
+			entry = db.S.cache.Fetch(src, func(old *PfEntry) *PfEntry {
+				return db.Fetch(id, query[0], qstring, src, old)
+			})
+
+			switch {
+			case entry.err != nil:
+				dbg(3, tag, "fetching %s failed: %s", src, entry.err)
 				continue
-			} else if status == 404 {
+			case entry.status == http.StatusNotFound:
 				// NB! special case: delete local file
 				if len(read_from) > 0 {
 					dbg(3, tag, "removing local copy of profile, %s", read_from)
-					os.Remove(read_from)
+					db.S.audit.Log("profile-removed", id, "", src, "HTTP status 404")
+					db.st.Remove(read_from)
 					read_from = ""
 				}
 				continue
-			} else if status != 200 {
-				dbg(3, tag, "HTTP status %d", status)
-				continue
 			}
 
-			// parse
-			in := make(map[string]interface{})
-			err = json.Unmarshal(pfbytes, &in)
-			if err != nil { dbg(3, tag, "JSON error: %s", err); continue }
-
-			// verify & ammend
-			pf, err = db.S.NewProfile(in, src)
-			if err != nil { dbg(3, tag, "profile error: %s", err); continue }
-
-			// write to disk
-			jsonb, err := pf.JSON()
-			if err == nil { err = ioutil.WriteFile(pfpath, jsonb, 0640) }
-			if err != nil { dbg(2, tag, "storing profile failed: %s", err) }
-
 			// ready for use!
-			dbg(3, tag, "fetched new profile from %s", src)
-			return pf, nil
+			return entry.Profile(), nil
 		}
 	}
 
 	// should read from disk?
 	if len(read_from) > 0 {
 		dbg(3, tag, "reading profile from %s", read_from)
+		if !fresh { db.S.metrics.Inc("ap_profile_fallback_total", labels("kind", "stale")) }
 
-		fh, err := os.Open(read_from)
+		jsonb, err := db.st.Read(read_from)
 		if err != nil { return nil, err }
-		defer fh.Close()
 
-		pf, err = db.S.ReadProfile(fh)
+		pf, err = db.S.ReadProfile(bytes.NewReader(jsonb))
 		if err != nil { return nil, err }
 	}
 
 	// handle empty profile
 	if len(pf) == 0 {
 		dbg(3, tag, "using empty profile")
+		db.S.metrics.Inc("ap_profile_fallback_total", labels("kind", "empty"))
 		pf, err = db.S.NewProfile(nil, "")
 		pf["@empty"] = true
 	}
@@ -314,6 +482,37 @@ func (db *DB) Authorize(id Identity) (pf Profile, err error) {
 	return
 }
 
+// QueryValue returns the identity value for pf_query[j], using @vendor for missing manufacturer
+func (db *DB) QueryValue(id Identity, j int) string {
+	v := id[pf_query[j]]
+	if j == 0 && len(v) == 0 { v = id["@vendor"] }
+	return v
+}
+
+// Quarantine returns the quarantine profile (or the empty profile if not set), and puts the
+// device on the admin review list
+func (db *DB) Quarantine(id Identity, reason string) (pf Profile, err error) {
+	dbg(2, "db", "%s: quarantined: %s", db.Tag(id), reason)
+
+	pf, err = db.ReadProfileAt(PF_QUARANTINE)
+	if os.IsNotExist(err) {
+		dbg(1, "db", "%s: no quarantine profile set (see /v1/quarantine/profile), using the empty profile",
+			db.Tag(id))
+		pf, err = db.S.NewProfile(nil, "")
+		pf["@empty"] = true
+	}
+	if err != nil { return nil, err }
+
+	pf["@quarantine"] = reason
+
+	// put on the review list
+	if err := db.AddReview(id, reason); err != nil {
+		dbg(0, "db", "%s: storing review entry failed: %s", db.Tag(id), err)
+	}
+
+	return pf, nil
+}
+
 // escape string val so it's safe to use in a URL
 func escape(val string) string {
 	var b bytes.Buffer
@@ -336,22 +535,3 @@ func escape(val string) string {
 
 	return string(bytes.Trim(b.Bytes(), "_"))
 }
-
-func (S *Server) http_get(url string) ([]byte, int, error) {
-	ctx, cancel := context.WithTimeout(S.ctx, HTTP_TIMEOUT)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil { return nil, -1, err }
-
-	// send the request
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil { return nil, -1, err }
-	defer resp.Body.Close()
-
-	// read all
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil { return nil, -1, err }
-
-	return bytes, resp.StatusCode, nil
-}
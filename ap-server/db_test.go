@@ -0,0 +1,91 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSupplement(t *testing.T) {
+	S := &Server{}
+	st, err := NewFileStore(t.TempDir())
+	if err != nil { t.Fatal(err) }
+	S.db = &DB{ S: S, st: st }
+
+	id := Identity{ "@switch": "sw1", "@port": "eth1", "@mac": "00:11:22:33:44:55",
+		"manufacturer": "acme", "device": "cam", "label": "device" }
+
+	files := map[string]string{
+		S.db.SwitchPath(id) + "/add.json": `{"site": "switch", "room": "switch", "label": "switch"}`,
+		S.db.SwitchPath(id) + "/set.json": `{"device": "switch-set", "@mac": "ff:ff:ff:ff:ff:ff"}`,
+		S.db.PortPath(id) + "/add.json":   `{"room": "port", "owner": "port"}`,
+		S.db.PortPath(id) + "/del.json":   `["site"]`,
+		S.db.MacPath(id) + "/add.json":    `{"room": "mac", "device": "mac-add", "site": "mac"}`,
+		S.db.MacPath(id) + "/set.json":    `{"owner": "mac-set"}`,
+	}
+	for path, data := range files {
+		if err := st.Write(path, []byte(data)); err != nil { t.Fatal(err) }
+	}
+
+	if err := S.db.Supplement(id); err != nil { t.Fatal(err) }
+
+	want := Identity{ "@switch": "sw1", "@port": "eth1", "@mac": "00:11:22:33:44:55",
+		"manufacturer": "acme",
+		"device": "switch-set", // set.json wins over a more specific add.json
+		"label": "device",      // add.json never overrides the device
+		"room": "mac",          // the most specific add.json wins
+		"site": "mac",          // deleted on port level, added back on MAC level
+		"owner": "mac-set",
+	}
+	if !reflect.DeepEqual(id, want) { t.Errorf("got %v, want %v", id, want) }
+}
+
+func TestBaseProfileLocal(t *testing.T) {
+	S := &Server{ cache: NewPfCache() }
+	st, err := NewFileStore(t.TempDir())
+	if err != nil { t.Fatal(err) }
+	S.db = &DB{ S: S, st: st }
+
+	id := Identity{ "@switch": "sw1", "@port": "eth1", "@mac": "00:11:22:33:44:55",
+		"manufacturer": "acme", "url": "https://example.com/profiles" }
+	src := S.db.ProfileQuery(id["url"], "acme")
+
+	// a fresh fetched profile, never written to the store
+	S.cache.Fetch(src, func(old *PfEntry) *PfEntry {
+		return &PfEntry{ status: 200, pf: Profile{ "@source": src }, expires: time.Now().Add(time.Hour) }
+	})
+
+	source := func() interface{} {
+		pf, err := S.db.BaseProfile(id)
+		if err != nil { t.Fatal(err) }
+		if _, ok := pf["@local"]; ok { return "local" }
+		return pf["@source"]
+	}
+
+	if got := source(); got != src { t.Errorf("fetched: got %v, want %s", got, src) }
+
+	if _, err := S.db.WriteProfile("acme", map[string]interface{}{}, true); err != nil { t.Fatal(err) }
+	if got := source(); got != "local" { t.Errorf("local: got %v, want local", got) }
+
+	if err := S.db.DelProfile("acme"); err != nil { t.Fatal(err) }
+	if got := source(); got != src { t.Errorf("deleted: got %v, want %s", got, src) }
+}
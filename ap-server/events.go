@@ -0,0 +1,136 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EVENTS_QUEUE = 100            // max. events queued per subscriber
+	EVENTS_KEEPALIVE = 30e9       // in nanoseconds
+)
+
+// Event tells a switch to re-authorize or deprovision devices
+type Event struct {
+	Action string `json:"action"`           // reauth or revoke
+	Switch string `json:"switch,omitempty"` // empty means all switches
+	Port   string `json:"port,omitempty"`   // empty means all ports
+	Mac    string `json:"mac,omitempty"`    // empty means all MACs
+	Reason string `json:"reason,omitempty"`
+}
+
+// Events delivers change notifications to subscribed switches
+type Events struct {
+	mutex sync.Mutex
+	subs  map[chan Event]string // channel -> switch name
+}
+
+func NewEvents() *Events {
+	return &Events{ subs: make(map[chan Event]string) }
+}
+
+// NewEvent returns an event for the device of id (use nil for all devices)
+func NewEvent(action string, id Identity, reason string) Event {
+	return Event{ action, id["@switch"], id["@port"], id["@mac"], reason }
+}
+
+func (ev *Events) Subscribe(sw string) chan Event {
+	ch := make(chan Event, EVENTS_QUEUE)
+
+	ev.mutex.Lock()
+	ev.subs[ch] = sw
+	ev.mutex.Unlock()
+
+	return ch
+}
+
+func (ev *Events) Unsubscribe(ch chan Event) {
+	ev.mutex.Lock()
+	delete(ev.subs, ch)
+	ev.mutex.Unlock()
+}
+
+// Notify sends e to the subscribers of its switch (if enabled)
+func (ev *Events) Notify(e Event) {
+	if ev == nil { return }
+
+	ev.mutex.Lock()
+	defer ev.mutex.Unlock()
+
+	dbg(3, "events", "%s %s/%s/%s: %s", e.Action, e.Switch, e.Port, e.Mac, e.Reason)
+	for ch, sw := range ev.subs {
+		if len(e.Switch) > 0 && e.Switch != sw { continue }
+
+		select {
+		case ch <- e:
+		default: dbg(1, "events", "%s: queue full, event dropped", sw)
+		}
+	}
+}
+
+// Events streams change notifications for ?switch=<name> as Server-Sent Events
+func (a *Api) Events(ar *ApiRequest) *ApiRequest {
+	if len(ar.query.Get("switch")) == 0 { return ar.Err(http.StatusBadRequest, "switch not given", nil) }
+
+	sw, err := a.S.SwitchName(ar.query.Get("switch"))
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid switch", err.Error()) }
+
+	// bind switch to the client certificate
+	if names, ok := ar.CertBound(sw); !ok {
+		return ar.Err(http.StatusForbidden, "switch does not match client certificate", names)
+	}
+
+	flusher, ok := ar.resp.(http.Flusher)
+	if !ok { return ar.Err(http.StatusInternalServerError, "streaming not supported", nil) }
+
+	ch := a.S.events.Subscribe(sw)
+	defer a.S.events.Unsubscribe(ch)
+
+	dbg(2, "events", "%s: subscribed", sw)
+	defer dbg(2, "events", "%s: unsubscribed", sw)
+
+	ar.resp.Header().Set("Content-Type", "text/event-stream")
+	ar.resp.Header().Set("Cache-Control", "no-cache")
+	ar.resp.WriteHeader(http.StatusOK)
+	ar.written = true
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ar.req.Context().Done():
+			return ar
+		case <-keepalive.C:
+			fmt.Fprintf(ar.resp, ": keepalive\n\n")
+		case e := <-ch:
+			jsonb, err := json.Marshal(&e)
+			if err != nil { continue }
+			fmt.Fprintf(ar.resp, "event: %s\ndata: %s\n\n", e.Action, jsonb)
+		}
+		flusher.Flush()
+	}
+}
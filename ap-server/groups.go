@@ -0,0 +1,255 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DB_GROUPS = "groups"
+	GROUP_FILE = "group.json"
+)
+
+var (
+	err_group_name = errors.New("invalid group name")
+)
+
+// Group is a named set of devices sharing a profile, e.g. all cameras
+//
+// A device is a member if its MAC is listed in Macs, or if all identity keys in Match
+// match their (case-insensitive) glob patterns, e.g. {"@vendor": "*hikvision*"}. In patterns,
+// '*' matches any string (including '/', e.g. in URLs) and '?' matches any single character.
+//
+type Group struct {
+	Name     string            `json:"name"`
+	Macs     []string          `json:"macs,omitempty"`
+	Match    map[string]string `json:"match,omitempty"` // see glob_match()
+	Priority int               `json:"priority"`   // higher is merged later (more specific)
+}
+
+func (db *DB) GroupPath(name string, file string) string {
+	return fmt.Sprintf("%s/%s/%s", DB_GROUPS, name, file)
+}
+
+// GroupCache keeps the parsed group definitions, see ListGroups()
+type GroupCache struct {
+	mutex  sync.Mutex
+	groups []*Group // nil if not loaded
+}
+
+// Verify checks the group definition, normalizing it in place
+func (g *Group) Verify() error {
+	if len(g.Name) == 0 || escape(g.Name) != g.Name { return err_group_name }
+
+	for i, mac := range g.Macs { g.Macs[i] = strings.ToLower(strings.TrimSpace(mac)) }
+
+	for k, pattern := range g.Match {
+		if len(k) == 0 { return fmt.Errorf("match: empty key") }
+		g.Match[k] = strings.ToLower(pattern)
+	}
+
+	return nil
+}
+
+// Member returns true if the device of id belongs to the group
+func (g *Group) Member(id Identity) bool {
+	for _, mac := range g.Macs {
+		if mac == id["@mac"] { return true }
+	}
+
+	if len(g.Match) == 0 { return false }
+	for k, pattern := range g.Match {
+		v, ok := id[k]
+		if !ok { return false }
+		if !glob_match(pattern, strings.ToLower(v)) { return false }
+	}
+	return true
+}
+
+// glob_match returns true if s matches pattern, where '*' matches any string and '?' any character
+func glob_match(pattern string, s string) bool {
+	p, r := []rune(pattern), []rune(s)
+	pi, ri := 0, 0
+	star, mark := -1, 0 // last '*' in p, and where in r it started matching
+
+	for ri < len(r) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == r[ri]):
+			pi++; ri++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ri
+			pi++
+		case star >= 0: // backtrack: let the last '*' eat one more character
+			mark++
+			pi, ri = star + 1, mark
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' { pi++ }
+	return pi == len(p)
+}
+
+// ReadGroup reads the definition of given group
+func (db *DB) ReadGroup(name string) (*Group, error) {
+	if len(name) == 0 || escape(name) != name { return nil, err_group_name }
+
+	jsonb, err := db.st.Read(db.GroupPath(name, GROUP_FILE))
+	if err != nil { return nil, err }
+
+	g := &Group{}
+	if err := json.Unmarshal(jsonb, g); err != nil { return nil, fmt.Errorf("group %s: %s", name, err) }
+	g.Name = name
+	return g, g.Verify()
+}
+
+// ListGroups returns all group definitions, in merge order (by priority, then by name)
+//
+// NB: the definitions are cached, so changes must go through the API (see PutGroup, DelGroup)
+func (db *DB) ListGroups() ([]*Group, error) {
+	db.gcache.mutex.Lock()
+	defer db.gcache.mutex.Unlock()
+
+	if db.gcache.groups != nil { return db.gcache.groups, nil }
+
+	groups, err := db.read_groups()
+	if err != nil { return nil, err }
+
+	dbg(3, "db", "loaded %d group definitions", len(groups))
+	db.gcache.groups = groups
+	return groups, nil
+}
+
+// FlushGroups invalidates the group cache
+func (db *DB) FlushGroups() {
+	db.gcache.mutex.Lock()
+	db.gcache.groups = nil
+	db.gcache.mutex.Unlock()
+}
+
+// read_groups reads all group definitions from the store
+func (db *DB) read_groups() ([]*Group, error) {
+	names, err := db.ListDir(DB_GROUPS)
+	if os.IsNotExist(err) { return []*Group{}, nil }
+	if err != nil { return nil, err }
+
+	ret := []*Group{}
+	for _, name := range names {
+		g, err := db.ReadGroup(name)
+		if os.IsNotExist(err) { continue } // NB: not defined (yet)
+		if err != nil { return nil, err }
+		ret = append(ret, g)
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Priority != ret[j].Priority { return ret[i].Priority < ret[j].Priority }
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// Groups returns the groups given identity belongs to, in merge order
+func (db *DB) Groups(id Identity) ([]*Group, error) {
+	groups, err := db.ListGroups()
+	if err != nil { return nil, err }
+
+	ret := []*Group{}
+	for _, g := range groups {
+		if g.Member(id) { ret = append(ret, g) }
+	}
+	return ret, nil
+}
+
+func (a *Api) ListGroups(ar *ApiRequest) *ApiRequest {
+	ret, err := a.S.db.ListGroups()
+	if err != nil { return ar.Err(db_status(err), "listing groups failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+func (a *Api) GetGroup(ar *ApiRequest) *ApiRequest {
+	g, err := a.S.db.ReadGroup(ar.param["group"])
+	if err == err_group_name { return ar.Err(http.StatusBadRequest, err.Error(), nil) }
+	if err != nil { return ar.Err(db_status(err), "reading group failed", err.Error()) }
+
+	ar.out = g
+	return ar
+}
+
+// PutGroup stores the group given in input JSON, e.g. {"match": {"@vendor": "*hikvision*"}}
+func (a *Api) PutGroup(ar *ApiRequest) *ApiRequest {
+	input, ok := ar.in.(map[string]interface{})
+	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
+
+	g := &Group{}
+	jsonb, err := json.Marshal(input)
+	if err == nil { err = json.Unmarshal(jsonb, g) }
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid input", err.Error()) }
+
+	g.Name = ar.param["group"]
+	if err := g.Verify(); err != nil { return ar.Err(http.StatusBadRequest, "invalid group", err.Error()) }
+
+	jsonb, err = json.MarshalIndent(g, "", "\t")
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid group", err.Error()) }
+
+	db := a.S.db
+	db.mutex.Lock()
+	err = db.st.Write(db.GroupPath(g.Name, GROUP_FILE), append(jsonb, '\n'))
+	db.FlushGroups()
+	db.mutex.Unlock()
+	if err != nil { return ar.Err(db_status(err), "storing group failed", err.Error()) }
+
+	dbg(1, "db", "group %s: stored", g.Name)
+	a.S.events.Notify(NewEvent("reauth", nil, "group changed: " + g.Name))
+
+	ar.out = g
+	return ar
+}
+
+// DelGroup removes given group, along with its profile
+func (a *Api) DelGroup(ar *ApiRequest) *ApiRequest {
+	name := ar.param["group"]
+	if len(name) == 0 || escape(name) != name { return ar.Err(http.StatusBadRequest, err_group_name.Error(), nil) }
+
+	db := a.S.db
+	dir := DB_GROUPS + "/" + name
+	db.mutex.Lock()
+	_, err := db.st.Stat(dir)
+	if err == nil { err = db.st.Remove(dir) }
+	db.FlushGroups()
+	db.mutex.Unlock()
+	if err != nil { return ar.Err(db_status(err), "deleting group failed", err.Error()) }
+
+	dbg(1, "db", "group %s: deleted", name)
+	a.S.events.Notify(NewEvent("reauth", nil, "group deleted: " + name))
+
+	ar.out = name
+	return ar
+}
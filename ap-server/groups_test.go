@@ -0,0 +1,73 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestGroupMember(t *testing.T) {
+	g := &Group{
+		Name:  "cameras",
+		Macs:  []string{ " 00:11:22:33:44:AA " },
+		Match: map[string]string{ "@vendor": "*HIKVISION*", "url": "https://*/cams/?" },
+	}
+	if err := g.Verify(); err != nil { t.Fatal(err) }
+
+	tests := []struct {
+		id   Identity
+		want bool
+	}{
+		{ Identity{ "@mac": "00:11:22:33:44:aa" }, true },
+		{ Identity{ "@mac": "00:11:22:33:44:bb", "@vendor": "Hangzhou Hikvision", "url": "https://x.com/a/cams/1" }, true },
+		{ Identity{ "@mac": "00:11:22:33:44:bb", "@vendor": "Hangzhou Hikvision", "url": "https://x.com/cams/12" }, false },
+		{ Identity{ "@mac": "00:11:22:33:44:bb", "@vendor": "Hangzhou Hikvision" }, false },
+		{ Identity{ "@mac": "00:11:22:33:44:bb", "@vendor": "Acme", "url": "https://x.com/cams/1" }, false },
+	}
+
+	for _, tt := range tests {
+		if got := g.Member(tt.id); got != tt.want { t.Errorf("%v: got %v, want %v", tt.id, got, tt.want) }
+	}
+
+	if (&Group{ Name: "Bad Name" }).Verify() == nil { t.Errorf("invalid group name accepted") }
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{ "", "", true },
+		{ "*", "", true },
+		{ "*", "a/b", true },
+		{ "a*c", "abbbc", true },
+		{ "a*c", "abbbd", false },
+		{ "a?c", "abc", true },
+		{ "a?c", "ac", false },
+		{ "*b*b*", "abcabc", true },
+		{ "*.com", "x.com.pl", false },
+	}
+
+	for _, tt := range tests {
+		if got := glob_match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("glob_match(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DB_HISTORY = "history" // identity revisions, in the MAC directory
+)
+
+var (
+	err_rev = errors.New("invalid revision")
+)
+
+// Revision is a stored identity revision, named after its UNIX time in nanoseconds
+type Revision struct {
+	Rev  string    `json:"rev"`
+	Time time.Time `json:"time"`
+}
+
+// IdentityDiff lists the differences between two identities
+type IdentityDiff struct {
+	Added   map[string]string    `json:"added"`
+	Removed map[string]string    `json:"removed"`
+	Changed map[string][2]string `json:"changed"` // old, new
+}
+
+func (db *DB) HistoryPath(id Identity) string {
+	return db.MacPath(id) + "/" + DB_HISTORY
+}
+
+// WriteIdentity stores id as the baseline identity of its MAC, and as a new revision
+//
+// NB: db.mutex must be held
+func (db *DB) WriteIdentity(id Identity) error {
+	pathid := db.MacPath(id) + "/identity.json"
+	hpath := db.HistoryPath(id)
+
+	jsonb, err := id.JSON()
+	if err != nil { return err }
+
+	// no history yet? keep the current baseline as the first revision
+	if _, err := db.st.Stat(hpath); os.IsNotExist(err) {
+		if stat, err := db.st.Stat(pathid); err == nil {
+			old, err := db.st.Read(pathid)
+			if err == nil { err = db.st.Write(fmt.Sprintf("%s/%d.json", hpath, stat.ModTime.UnixNano()), old) }
+			if err != nil { return err }
+		}
+	}
+
+	err = db.st.Write(fmt.Sprintf("%s/%d.json", hpath, time.Now().UnixNano()), jsonb)
+	if err != nil { return err }
+
+	return db.st.Write(pathid, jsonb)
+}
+
+// ListRevisions returns all identity revisions of given MAC, oldest first
+func (db *DB) ListRevisions(id Identity) ([]Revision, error) {
+	if _, err := db.ReadMac(id); err != nil { return nil, err }
+
+	files, err := db.st.List(db.HistoryPath(id))
+	if os.IsNotExist(err) { return []Revision{}, nil }
+	if err != nil { return nil, err }
+
+	ret := []Revision{}
+	for _, f := range files {
+		rev := strings.TrimSuffix(f.Name, ".json")
+		ns, err := strconv.ParseInt(rev, 10, 64)
+		if err != nil || f.IsDir { continue }
+		ret = append(ret, Revision{ rev, time.Unix(0, ns).UTC() })
+	}
+	return ret, nil
+}
+
+// ReadRevision returns given identity revision, or the current baseline if rev is empty
+func (db *DB) ReadRevision(id Identity, rev string) (Identity, error) {
+	if len(rev) == 0 || rev == "current" { return db.ReadMac(id) }
+	if _, err := strconv.ParseUint(rev, 10, 63); err != nil { return nil, err_rev }
+
+	jsonb, err := db.st.Read(fmt.Sprintf("%s/%s.json", db.HistoryPath(id), rev))
+	if err != nil { return nil, err }
+
+	return db.S.ReadIdentity(bytes.NewReader(jsonb))
+}
+
+// Rollback restores given revision as the baseline identity (stored as a new revision)
+func (db *DB) Rollback(id Identity, rev string) (Identity, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if len(rev) == 0 || rev == "current" { return nil, err_rev }
+	old, err := db.ReadRevision(id, rev)
+	if err != nil { return nil, err }
+
+	// the MAC could have been moved in the meantime
+	for _, k := range required { old[k] = id[k] }
+
+	dbg(1, "db", "%s: rolling back identity to revision %s", db.Tag(id), rev)
+	return old, db.WriteIdentity(old)
+}
+
+// identity_diff compares identities a and b
+func identity_diff(a Identity, b Identity) *IdentityDiff {
+	d := &IdentityDiff{ make(map[string]string), make(map[string]string), make(map[string][2]string) }
+
+	for k, av := range a {
+		bv, ok := b[k]
+		switch {
+		case !ok:     d.Removed[k] = av
+		case av != bv: d.Changed[k] = [2]string{ av, bv }
+		}
+	}
+	for k, bv := range b {
+		if _, ok := a[k]; !ok { d.Added[k] = bv }
+	}
+
+	return d
+}
+
+func rev_status(err error) int {
+	if err == err_rev { return http.StatusBadRequest }
+	return db_status(err)
+}
+
+func (a *Api) ListRevisions(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	ret, err := a.S.db.ListRevisions(id)
+	if err != nil { return ar.Err(db_status(err), "listing revisions failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+func (a *Api) GetRevision(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	ret, err := a.S.db.ReadRevision(id, ar.param["rev"])
+	if err != nil { return ar.Err(rev_status(err), "reading revision failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+// DiffRevisions compares two revisions, e.g. ?from=<rev>&to=<rev> (default: current baseline)
+func (a *Api) DiffRevisions(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	from, err := a.S.db.ReadRevision(id, ar.query.Get("from"))
+	if err != nil { return ar.Err(rev_status(err), "reading revision 'from' failed", err.Error()) }
+
+	to, err := a.S.db.ReadRevision(id, ar.query.Get("to"))
+	if err != nil { return ar.Err(rev_status(err), "reading revision 'to' failed", err.Error()) }
+
+	ar.out = identity_diff(from, to)
+	return ar
+}
+
+// Rollback restores the revision given in input JSON, e.g. {"rev": "1600000000000000000"}
+func (a *Api) Rollback(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	input, ok := ar.in.(map[string]interface{})
+	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
+	rev, _ := input["rev"].(string)
+
+	ret, err := a.S.db.Rollback(id, rev)
+	if err != nil { return ar.Err(rev_status(err), "rollback failed", err.Error()) }
+
+	a.S.audit.Log("rollback", ret, "", "", "identity rolled back to revision " + rev)
+	a.S.events.Notify(NewEvent("reauth", ret, "identity rolled back"))
+	ar.out = ret
+	return ar
+}
@@ -0,0 +1,121 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	HOST_BACKOFF = 10 * time.Second       // initial backoff after a failure
+	HOST_BACKOFF_MAX = 10 * time.Minute   // max. backoff
+)
+
+var (
+	err_host_down = errors.New("host down, circuit open")
+)
+
+// Hosts tracks the health of upstream profile servers
+//
+// After a failure, the circuit opens and no requests are sent to the host until the backoff
+// expires; the backoff doubles with each consecutive failure. When it expires, a single probe
+// request is let through (half-open): if it succeeds, the circuit closes again.
+type Hosts struct {
+	mutex  sync.Mutex
+	hosts  map[string]*HostHealth
+}
+
+type HostHealth struct {
+	Host      string    `json:"host"`
+	State     string    `json:"state"`               // closed, open, half-open
+	Failures  int       `json:"failures"`            // consecutive failures
+	LastError string    `json:"last_error,omitempty"`
+	LastOk    time.Time `json:"last_ok,omitempty"`
+	LastFail  time.Time `json:"last_fail,omitempty"`
+	Until     time.Time `json:"until,omitempty"`     // circuit open until
+}
+
+func NewHosts() *Hosts {
+	return &Hosts{ hosts: make(map[string]*HostHealth) }
+}
+
+// Allow returns err_host_down if no request should be sent to host now
+func (hs *Hosts) Allow(host string) error {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	h, ok := hs.hosts[host]
+	if !ok || h.State == "closed" { return nil }
+
+	now := time.Now()
+	if now.Before(h.Until) { return err_host_down }
+
+	// half-open: let one probe through, block the rest until it's done
+	h.State = "half-open"
+	h.Until = now.Add(HTTP_TIMEOUT)
+	return nil
+}
+
+// Done records the result of a request sent to host
+func (hs *Hosts) Done(host string, err error) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	h, ok := hs.hosts[host]
+	if !ok {
+		h = &HostHealth{ Host: host, State: "closed" }
+		hs.hosts[host] = h
+	}
+
+	now := time.Now()
+	if err == nil {
+		if h.State != "closed" { dbg(1, "hosts", "%s: back up after %d failures", host, h.Failures) }
+		h.State, h.Failures, h.LastOk, h.Until = "closed", 0, now, time.Time{}
+		return
+	}
+
+	// exponential backoff
+	backoff := HOST_BACKOFF
+	for i := 0; i < h.Failures && backoff < HOST_BACKOFF_MAX; i++ { backoff *= 2 }
+	if backoff > HOST_BACKOFF_MAX { backoff = HOST_BACKOFF_MAX }
+
+	h.Failures++
+	h.State, h.LastError, h.LastFail, h.Until = "open", err.Error(), now, now.Add(backoff)
+	dbg(2, "hosts", "%s: failure %d (%s), backing off for %s", host, h.Failures, err, backoff)
+}
+
+// List returns a copy of the health of all hosts
+func (hs *Hosts) List() []HostHealth {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	ret := []HostHealth{}
+	for _, h := range hs.hosts { ret = append(ret, *h) }
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Host < ret[j].Host })
+	return ret
+}
+
+func (a *Api) ListHosts(ar *ApiRequest) *ApiRequest {
+	ar.out = a.S.hosts.List()
+	return ar
+}
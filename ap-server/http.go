@@ -0,0 +1,162 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HTTP_TIMEOUT = 10e9      // in nanoseconds
+	HTTP_MAX_SIZE = 1 << 20  // max. response size
+	HTTP_MAX_REDIRECTS = 3
+)
+
+var (
+	err_http_size = errors.New("HTTP response too big")
+	err_http_redirects = errors.New("too many HTTP redirects")
+	err_http_downgrade = errors.New("HTTP redirect from https:// to http://")
+	err_http_pin = errors.New("TLS certificate does not match the pinned keys")
+)
+
+func (S *Server) http_init() error {
+	tlsconf := &tls.Config{}
+
+	// custom CA bundle?
+	if len(S.opts.ca) > 0 {
+		pem, err := ioutil.ReadFile(S.opts.ca)
+		if err != nil { return err }
+
+		tlsconf.RootCAs = x509.NewCertPool()
+		if !tlsconf.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New(S.opts.ca + ": no certificates found")
+		}
+	}
+
+	// certificate pinning?
+	if len(S.opts.pins) > 0 {
+		jsonb, err := ioutil.ReadFile(S.opts.pins)
+		if err == nil { err = json.Unmarshal(jsonb, &S.pins) }
+		if err != nil { return err }
+
+		tlsconf.VerifyConnection = S.http_verify_pins
+	}
+
+	// max 100 idle connections, kill them after 30s
+	S.http.Transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsconf,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     30 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+
+	// follow a few redirects, but never downgrade to plain HTTP
+	S.http.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= HTTP_MAX_REDIRECTS { return err_http_redirects }
+		if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" { return err_http_downgrade }
+		return nil
+	}
+
+	return nil
+}
+
+// http_verify_pins checks the server certificate chain against SHA-256 pins of public keys
+// (base64-encoded, as in HPKP), configured per host name in the -pins file
+func (S *Server) http_verify_pins(cs tls.ConnectionState) error {
+	pins, ok := S.pins[strings.ToLower(cs.ServerName)]
+	if !ok { return nil } // not pinned
+
+	for _, cert := range cs.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		enc := base64.StdEncoding.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if pin == enc { return nil }
+		}
+	}
+
+	return err_http_pin
+}
+
+// http_url checks if url is allowed as a source of profiles
+func (S *Server) http_url(url string) bool {
+	switch {
+	case strings.HasPrefix(url, "https://"): return len(url) > len("https://")
+	case strings.HasPrefix(url, "http://"):  return len(url) > len("http://") && !S.opts.https
+	default:                                 return false
+	}
+}
+
+func (S *Server) http_get(url string) ([]byte, int, error) {
+	bytes, status, _, err := S.http_get_cond(url, "", "")
+	return bytes, status, err
+}
+
+// http_get_cond does a conditional GET if etag or lastmod is given, returns the response headers
+func (S *Server) http_get_cond(url string, etag string, lastmod string) ([]byte, int, http.Header, error) {
+	ctx, cancel := context.WithTimeout(S.ctx, HTTP_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil { return nil, -1, nil, err }
+	if len(etag) > 0 { req.Header.Set("If-None-Match", etag) }
+	if len(lastmod) > 0 { req.Header.Set("If-Modified-Since", lastmod) }
+
+	// host known to be down?
+	host := req.URL.Host
+	mhost := S.metrics.Host(host)
+	if err := S.hosts.Allow(host); err != nil {
+		S.metrics.Inc("ap_fetch_total", labels("host", mhost, "status", "circuit-open"))
+		return nil, -1, nil, err
+	}
+
+	// send the request
+	start := time.Now()
+	resp, err := S.http.Do(req)
+	S.metrics.Observe("ap_fetch_duration_seconds", labels("host", mhost), time.Since(start).Seconds())
+	if err != nil {
+		S.metrics.Inc("ap_fetch_total", labels("host", mhost, "status", "error"))
+		S.hosts.Done(host, err)
+		return nil, -1, nil, err
+	}
+	defer resp.Body.Close()
+	S.metrics.Inc("ap_fetch_total", labels("host", mhost, "status", fmt.Sprintf("%d", resp.StatusCode)))
+
+	// read all, up to HTTP_MAX_SIZE
+	bytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, HTTP_MAX_SIZE + 1))
+	if err == nil && resp.StatusCode >= 500 { err = fmt.Errorf("HTTP status %d", resp.StatusCode) }
+	S.hosts.Done(host, err)
+	if err != nil { return nil, -1, nil, err }
+	if len(bytes) > HTTP_MAX_SIZE { return nil, -1, nil, err_http_size }
+
+	return bytes, resp.StatusCode, resp.Header, nil
+}
@@ -23,7 +23,7 @@ import (
 	"fmt"
 	"strings"
 	"io/ioutil"
-	"os"
+	"io"
 	"encoding/json"
 )
 
@@ -58,6 +58,15 @@ func (S *Server) NewIdentity(in map[string]interface{}) (id Identity, err error)
     return id, nil
 }
 
+// SwitchName validates and normalizes a switch name given outside of an identity
+func (S *Server) SwitchName(name string) (string, error) {
+	if len(name) == 0 { return "", fmt.Errorf("@switch: empty") }
+
+	id, err := S.NewIdentity(map[string]interface{}{ "@switch": name })
+	if err != nil { return "", err }
+	return id["@switch"], nil
+}
+
 func (id Identity) CheckRequired() error {
 	for _,k := range required {
 		if _, ok := id[k]; !ok {
@@ -67,7 +76,7 @@ func (id Identity) CheckRequired() error {
 	return nil
 }
 
-func (S *Server) ReadIdentity(fh *os.File) (id Identity, err error) {
+func (S *Server) ReadIdentity(fh io.Reader) (id Identity, err error) {
 	jsonb, err := ioutil.ReadAll(fh)
 	if err != nil { return }
 
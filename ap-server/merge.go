@@ -0,0 +1,286 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	PF_SITE = "_site"             // site-wide profile (NB: escape() never returns a leading '_')
+	PF_MAC_FILE = "profile.json"  // per-MAC override, in the MAC directory
+)
+
+var (
+	err_layer = errors.New("invalid layer, must be site")
+
+	pf_directions = [...]string{ "from_device", "to_device" }
+)
+
+// PfLayer is a profile taking part in the merge
+type PfLayer struct {
+	Name     string  // e.g. "site", "group:cameras" or "mac"
+	Pf       Profile
+	Override bool    // may replace the allow list (per-MAC override)
+}
+
+// Layers returns the local profile layers for given identity, least specific first
+func (db *DB) Layers(id Identity) ([]PfLayer, error) {
+	ret := []PfLayer{}
+
+	add := func(name string, path string, override bool) error {
+		jsonb, err := db.st.Read(path)
+		if os.IsNotExist(err) { return nil }
+		if err != nil { return err }
+
+		pf, err := db.S.ReadProfile(bytes.NewReader(jsonb))
+		if err != nil { return err }
+
+		ret = append(ret, PfLayer{ name, pf, override })
+		return nil
+	}
+
+	if err := add("site", db.ProfilePath(PF_SITE, "profile.json"), false); err != nil { return nil, err }
+
+	groups, err := db.Groups(id)
+	if err != nil { return nil, err }
+	for _, g := range groups {
+		if err := add("group:" + g.Name, db.GroupPath(g.Name, "profile.json"), false); err != nil { return nil, err }
+	}
+
+	if err := add("mac", db.MacPath(id) + "/" + PF_MAC_FILE, true); err != nil { return nil, err }
+
+	return ret, nil
+}
+
+// Merge combines the base profile pf (manufacturer or MUD) with the local layers for id
+//
+// The layers are applied in order: manufacturer, site-wide, groups (see Groups()), per-MAC
+// override. For each direction:
+//  - rate: the minimum of all layers is used, i.e. local layers can only lower the rate
+//  - block: the union of all layers is used, i.e. entries can be added but never removed
+//  - allow: site-wide and group layers intersect with the inherited list (comparing the service
+//    specs as strings), i.e. they can only narrow it down - or set it, if nothing was inherited.
+//    Only the per-MAC override replaces the list, as an explicit decision for a single device.
+//
+// NB: ap-switch applies block before allow, so blocked entries stay blocked anyway.
+//
+// The result has "@provenance", which maps each rule (e.g. "from_device.rate") to the layer it
+// comes from - or, for block and allow, to a list with one value per entry (for allow, the
+// layers that have the entry, joined with '+').
+//
+func (db *DB) Merge(id Identity, pf Profile) (Profile, error) {
+	layers, err := db.Layers(id)
+	if err != nil { return nil, err }
+	if len(layers) == 0 { return pf, nil } // nothing to do
+
+	ret := merge_profiles(PfLayer{ "manufacturer", pf, false }, layers)
+	dbg(3, "db", "%s: merged profile: %s", db.Tag(id), ret["@source"])
+	return ret, nil
+}
+
+// merge_profiles implements Merge, without modifying any of the layers
+func merge_profiles(base PfLayer, layers []PfLayer) Profile {
+	ret := make(Profile)
+	prov := make(map[string]interface{})
+
+	// take the internal keys from base
+	for k, v := range base.Pf {
+		if len(k) > 0 && k[0] == '@' { ret[k] = v }
+	}
+
+	all := append([]PfLayer{ base }, layers...)
+	for _, dir := range pf_directions {
+		rules := make(map[string]interface{})
+
+		var (
+			rate, rate_from       = 0.0, ""
+			allow, allow_from     = []string(nil), []interface{}(nil)
+			block, block_from     = []string{}, []interface{}{}
+			blocked               = make(map[string]bool)
+		)
+
+		for _, l := range all {
+			lr, ok := l.Pf[dir].(map[string]interface{})
+			if !ok { continue }
+
+			if vi, ok := lr["rate"]; ok {
+				if r, err := profile_rate(vi); err == nil && (len(rate_from) == 0 || r < rate) {
+					rate, rate_from = r, l.Name
+				}
+			}
+
+			if vi, ok := lr["block"]; ok {
+				specs, _ := service_specs(vi) // NB: verified already
+				for _, spec := range specs {
+					if blocked[spec] { continue }
+					blocked[spec] = true
+					block = append(block, spec)
+					block_from = append(block_from, l.Name)
+				}
+			}
+
+			if vi, ok := lr["allow"]; ok {
+				specs, _ := service_specs(vi)
+				allow, allow_from = merge_allow(allow, allow_from, specs, l)
+			}
+		}
+
+		if len(rate_from) > 0 {
+			rules["rate"] = rate
+			prov[dir + ".rate"] = rate_from
+		}
+		if len(block) > 0 {
+			rules["block"] = block
+			prov[dir + ".block"] = block_from
+		}
+		if allow != nil {
+			rules["allow"] = allow
+			prov[dir + ".allow"] = allow_from
+		}
+
+		if len(rules) > 0 { ret[dir] = rules }
+	}
+
+	// describe the sources
+	source, _ := base.Pf["@source"].(string)
+	if _, ok := base.Pf["@empty"]; ok { source = "empty" }
+	names := []string{ source }
+	for _, l := range layers { names = append(names, l.Name) }
+	ret["@source"] = strings.Join(names, "+")
+
+	if len(prov) > 0 { delete(ret, "@empty") }
+	ret["@provenance"] = prov
+	return ret
+}
+
+// merge_allow applies the allow specs of layer l to the inherited allow list (nil if none)
+func merge_allow(allow []string, from []interface{}, specs []string, l PfLayer) ([]string, []interface{}) {
+	ret, ret_from := []string{}, []interface{}{}
+
+	if allow == nil || l.Override {
+		for _, spec := range specs {
+			ret = append(ret, spec)
+			ret_from = append(ret_from, l.Name)
+		}
+		return ret, ret_from
+	}
+
+	has := make(map[string]bool)
+	for _, spec := range specs { has[spec] = true }
+
+	for i, spec := range allow {
+		if !has[spec] { continue }
+		ret = append(ret, spec)
+		ret_from = append(ret_from, from[i].(string) + "+" + l.Name)
+	}
+	return ret, ret_from
+}
+
+// layer_path returns the profile file path for the layer given in URI params, and the path that
+// must exist before the profile can be stored (if any)
+func (a *Api) layer_path(ar *ApiRequest) (string, string, Identity, error) {
+	db := a.S.db
+
+	if name, ok := ar.param["group"]; ok {
+		if len(name) == 0 || escape(name) != name { return "", "", nil, err_group_name }
+		return db.GroupPath(name, "profile.json"), db.GroupPath(name, GROUP_FILE), nil, nil
+	}
+
+	switch ar.param["layer"] {
+	case "site": return db.ProfilePath(PF_SITE, "profile.json"), "", nil, nil
+	case "":     break
+	default:     return "", "", nil, err_layer
+	}
+
+	id, err := ar.ParamId()
+	if err != nil { return "", "", nil, err }
+
+	return db.MacPath(id) + "/" + PF_MAC_FILE, db.MacPath(id), id, nil
+}
+
+func (a *Api) GetLayer(ar *ApiRequest) *ApiRequest {
+	path, _, _, err := a.layer_path(ar)
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid layer", err.Error()) }
+
+	jsonb, err := a.S.db.st.Read(path)
+	if err != nil { return ar.Err(db_status(err), "reading profile failed", err.Error()) }
+
+	pf, err := a.S.ReadProfile(bytes.NewReader(jsonb))
+	if err != nil { return ar.Err(http.StatusInternalServerError, "reading profile failed", err.Error()) }
+
+	ar.out = pf
+	return ar
+}
+
+// PutLayer stores the site-wide, group or per-MAC profile given in input JSON
+func (a *Api) PutLayer(ar *ApiRequest) *ApiRequest {
+	path, owner, id, err := a.layer_path(ar)
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid layer", err.Error()) }
+
+	input, ok := ar.in.(map[string]interface{})
+	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
+
+	pf, err := a.S.NewLocalProfile(input)
+	if err != nil {
+		if pe, ok := err.(ProfileError); ok { return ar.Err(http.StatusBadRequest, "invalid profile", pe) }
+		return ar.Err(http.StatusBadRequest, "invalid profile", err.Error())
+	}
+
+	jsonb, err := pf.JSON()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid profile", err.Error()) }
+
+	db := a.S.db
+	db.mutex.Lock()
+	if len(owner) > 0 { // NB: e.g. never authorize the MAC implicitly
+		_, err = db.st.Stat(owner)
+	}
+	if err == nil { err = db.st.Write(path, jsonb) }
+	db.mutex.Unlock()
+	if err != nil { return ar.Err(db_status(err), "storing profile failed", err.Error()) }
+
+	dbg(1, "db", "%s: writing local profile", path)
+	a.S.events.Notify(NewEvent("reauth", id, "profile changed: " + path))
+
+	ar.out = pf
+	return ar
+}
+
+func (a *Api) DelLayer(ar *ApiRequest) *ApiRequest {
+	path, _, id, err := a.layer_path(ar)
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid layer", err.Error()) }
+
+	db := a.S.db
+	db.mutex.Lock()
+	_, err = db.st.Stat(path)
+	if err == nil { err = db.st.Remove(path) }
+	db.mutex.Unlock()
+	if err != nil { return ar.Err(db_status(err), "deleting profile failed", err.Error()) }
+
+	dbg(1, "db", "%s: deleting local profile", path)
+	a.S.events.Notify(NewEvent("reauth", id, "profile deleted: " + path))
+
+	ar.out = map[string]interface{}{}
+	return ar
+}
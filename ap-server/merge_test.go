@@ -0,0 +1,139 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func rules(kv ...interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for i := 0; i+1 < len(kv); i += 2 { ret[kv[i].(string)] = kv[i+1] }
+	return ret
+}
+
+func TestMergeProfiles(t *testing.T) {
+	base := Profile{
+		"@source": "https://example.com",
+		"from_device": rules(
+			"rate", 100.0,
+			"allow", []interface{}{ "dst 10.0.0.1 tcp 443", "udp" },
+			"block", "dst 8.8.8.8"),
+	}
+
+	tests := []struct {
+		name   string
+		layers []PfLayer
+		want   map[string]interface{} // from_device
+		prov   map[string]interface{}
+		source string
+	}{
+		{
+			"rate minimum",
+			[]PfLayer{
+				{ "site", Profile{ "from_device": rules("rate", "10") }, false },
+				{ "mac", Profile{ "from_device": rules("rate", 50.0) }, true },
+			},
+			rules("rate", 10.0, "allow", []string{ "dst 10.0.0.1 tcp 443", "udp" }, "block", []string{ "dst 8.8.8.8" }),
+			map[string]interface{}{
+				"from_device.rate":  "site",
+				"from_device.allow": []interface{}{ "manufacturer", "manufacturer" },
+				"from_device.block": []interface{}{ "manufacturer" },
+			},
+			"https://example.com+site+mac",
+		},
+		{
+			"block union",
+			[]PfLayer{
+				{ "site", Profile{ "from_device": rules("block", []interface{}{ "dst 9.9.9.9", "dst 8.8.8.8" }) }, false },
+				{ "group:cameras", Profile{ "from_device": rules("block", "tcp") }, false },
+			},
+			rules("rate", 100.0, "allow", []string{ "dst 10.0.0.1 tcp 443", "udp" },
+				"block", []string{ "dst 8.8.8.8", "dst 9.9.9.9", "tcp" }),
+			map[string]interface{}{
+				"from_device.rate":  "manufacturer",
+				"from_device.allow": []interface{}{ "manufacturer", "manufacturer" },
+				"from_device.block": []interface{}{ "manufacturer", "site", "group:cameras" },
+			},
+			"https://example.com+site+group:cameras",
+		},
+		{
+			"allow intersection",
+			[]PfLayer{
+				{ "site", Profile{ "from_device": rules("allow", []interface{}{ "udp", "icmp" }) }, false },
+			},
+			rules("rate", 100.0, "allow", []string{ "udp" }, "block", []string{ "dst 8.8.8.8" }),
+			map[string]interface{}{
+				"from_device.rate":  "manufacturer",
+				"from_device.allow": []interface{}{ "manufacturer+site" },
+				"from_device.block": []interface{}{ "manufacturer" },
+			},
+			"https://example.com+site",
+		},
+		{
+			"allow override",
+			[]PfLayer{
+				{ "site", Profile{ "from_device": rules("allow", "icmp") }, false },
+				{ "mac", Profile{ "from_device": rules("allow", []interface{}{ "tcp" }) }, true },
+			},
+			rules("rate", 100.0, "allow", []string{ "tcp" }, "block", []string{ "dst 8.8.8.8" }),
+			map[string]interface{}{
+				"from_device.rate":  "manufacturer",
+				"from_device.allow": []interface{}{ "mac" },
+				"from_device.block": []interface{}{ "manufacturer" },
+			},
+			"https://example.com+site+mac",
+		},
+	}
+
+	for _, tt := range tests {
+		pf := merge_profiles(PfLayer{ "manufacturer", base, false }, tt.layers)
+
+		if got := pf["from_device"]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: from_device = %#v, want %#v", tt.name, got, tt.want)
+		}
+		if got := pf["@provenance"]; !reflect.DeepEqual(got, tt.prov) {
+			t.Errorf("%s: @provenance = %#v, want %#v", tt.name, got, tt.prov)
+		}
+		if got := pf["@source"]; got != tt.source {
+			t.Errorf("%s: @source = %v, want %s", tt.name, got, tt.source)
+		}
+		if err := VerifyProfile(pf); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+	}
+
+	// the layers must stay untouched
+	if _, ok := base["from_device"].(map[string]interface{})["block"].(string); !ok {
+		t.Errorf("base profile modified: %#v", base)
+	}
+}
+
+func TestMergeEmpty(t *testing.T) {
+	base := Profile{ "@source": "", "@empty": true }
+	pf := merge_profiles(PfLayer{ "manufacturer", base, false },
+		[]PfLayer{ { "group:sensors", Profile{ "to_device": rules("rate", 1.0) }, false } })
+
+	if _, ok := pf["@empty"]; ok { t.Errorf("@empty kept: %#v", pf) }
+	if pf["@source"] != "empty+group:sensors" { t.Errorf("@source = %v", pf["@source"]) }
+	if _, ok := base["@provenance"]; ok { t.Errorf("base profile modified: %#v", base) }
+}
+
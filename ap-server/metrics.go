@@ -0,0 +1,193 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics implements counters and histograms in the Prometheus text exposition format
+type Metrics struct {
+	mutex    sync.Mutex
+	help     map[string]string
+	kind     map[string]string                 // counter or histogram
+	counters map[string]map[string]float64     // name -> labels -> value
+	hists    map[string]map[string]*Histogram  // name -> labels -> histogram
+	hosts    map[string]bool                   // host names used as label values, see Host()
+}
+
+type Histogram struct {
+	counts []uint64 // per bucket
+	sum    float64
+	count  uint64
+}
+
+// latency buckets, in seconds
+var metrics_buckets = []float64{ .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10 }
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		help:     make(map[string]string),
+		kind:     make(map[string]string),
+		counters: make(map[string]map[string]float64),
+		hists:    make(map[string]map[string]*Histogram),
+		hosts:    make(map[string]bool),
+	}
+
+	m.Counter("ap_authorize_total", "Authorization requests by outcome")
+	m.Histogram("ap_authorize_duration_seconds", "Latency of /v1/authorize requests")
+	m.Counter("ap_auto_add_total", "MAC addresses added automatically")
+	m.Counter("ap_mac_moved_total", "MAC addresses seen on another switch port, by -mobility policy")
+	m.Counter("ap_profile_cache_total", "Profile cache lookups by result (hit, stale, miss)")
+	m.Counter("ap_profile_fallback_total", "Profiles served without a fresh copy (stale, empty)")
+	m.Counter("ap_fetch_total", "Upstream profile fetches by host (see -metrics-hosts) and HTTP status")
+	m.Histogram("ap_fetch_duration_seconds", "Latency of upstream profile fetches by host (see -metrics-hosts)")
+
+	return m
+}
+
+func (m *Metrics) Counter(name string, help string) {
+	m.help[name], m.kind[name] = help, "counter"
+	m.counters[name] = make(map[string]float64)
+}
+
+func (m *Metrics) Histogram(name string, help string) {
+	m.help[name], m.kind[name] = help, "histogram"
+	m.hists[name] = make(map[string]*Histogram)
+}
+
+// AddHost allows given host name as a label value, see Host()
+func (m *Metrics) AddHost(host string) {
+	m.mutex.Lock()
+	m.hosts[strings.ToLower(host)] = true
+	m.mutex.Unlock()
+}
+
+// Host returns the label value for hostport: the host name if added by AddHost(), or "other"
+//
+// NB: the hosts come from device URLs, so they can't be used as label values as they are
+func (m *Metrics) Host(hostport string) string {
+	if m == nil { return "" }
+
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil { host = h }
+	host = strings.ToLower(host)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.hosts[host] { return host }
+	return "other"
+}
+
+// labels formats label pairs, e.g. labels("host", "example.com")
+func labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 { b.WriteByte(',') }
+		fmt.Fprintf(&b, "%s=%q", kv[i], kv[i+1])
+	}
+	return b.String()
+}
+
+// Inc increments counter name with given labels (if metrics are enabled)
+func (m *Metrics) Inc(name string, labels string) {
+	if m == nil { return }
+
+	m.mutex.Lock()
+	m.counters[name][labels]++
+	m.mutex.Unlock()
+}
+
+// Observe adds val to histogram name with given labels (if metrics are enabled)
+func (m *Metrics) Observe(name string, labels string, val float64) {
+	if m == nil { return }
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h, ok := m.hists[name][labels]
+	if !ok {
+		h = &Histogram{ counts: make([]uint64, len(metrics_buckets)) }
+		m.hists[name][labels] = h
+	}
+
+	for i, le := range metrics_buckets {
+		if val <= le { h.counts[i]++ }
+	}
+	h.sum += val
+	h.count++
+}
+
+func (m *Metrics) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var b bytes.Buffer
+
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.kind))
+	for name := range m.kind { names = append(names, name) }
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, m.help[name], name, m.kind[name])
+
+		if m.kind[name] == "counter" {
+			for _, l := range sorted_keys(m.counters[name]) {
+				fmt.Fprintf(&b, "%s%s %g\n", name, braces(l), m.counters[name][l])
+			}
+			continue
+		}
+
+		var hkeys []string
+		for l := range m.hists[name] { hkeys = append(hkeys, l) }
+		sort.Strings(hkeys)
+
+		for _, l := range hkeys {
+			h := m.hists[name][l]
+			sep := ""
+			if len(l) > 0 { sep = "," }
+			for i, le := range metrics_buckets {
+				fmt.Fprintf(&b, "%s_bucket{%s%sle=\"%g\"} %d\n", name, l, sep, le, h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, l, sep, h.count)
+			fmt.Fprintf(&b, "%s_sum%s %g\n%s_count%s %d\n", name, braces(l), h.sum, name, braces(l), h.count)
+		}
+	}
+	m.mutex.Unlock()
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	resp.Write(b.Bytes())
+}
+
+func braces(labels string) string {
+	if len(labels) == 0 { return "" }
+	return "{" + labels + "}"
+}
+
+func sorted_keys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m { keys = append(keys, k) }
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,40 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMetricsHost(t *testing.T) {
+	m := NewMetrics()
+	m.AddHost("Profiles.example.com")
+
+	tests := map[string]string{
+		"profiles.example.com":      "profiles.example.com",
+		"PROFILES.example.com:8443": "profiles.example.com",
+		"evil.example.com":          "other",
+		"[2001:db8::1]:443":         "other",
+	}
+	for hostport, want := range tests {
+		if got := m.Host(hostport); got != want { t.Errorf("%s: got %s, want %s", hostport, got, want) }
+	}
+}
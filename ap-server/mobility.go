@@ -0,0 +1,146 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	err_mac_moved = errors.New("MAC address already authorized on another port")
+)
+
+// MacIndex maps MACs to the switch ports they're authorized on, see FindMac()
+//
+// NB: guarded by db.mutex; changes of the MAC directories must call mac_added() and mac_removed()
+type MacIndex map[string][]Identity
+
+// mac_index returns the MAC index, loading it from the store if needed
+//
+// NB: db.mutex must be held
+func (db *DB) mac_index() (MacIndex, error) {
+	if db.macs != nil { return db.macs, nil }
+
+	idx := make(MacIndex)
+	switches, err := db.ListDir(DB_IDS)
+	if err != nil && !os.IsNotExist(err) { return nil, err }
+
+	for _, sw := range switches {
+		ports, err := db.ListDir(DB_IDS + "/" + sw)
+		if err != nil { return nil, err }
+
+		for _, port := range ports {
+			macs, err := db.ListDir(DB_IDS + "/" + sw + "/" + port)
+			if err != nil { return nil, err }
+
+			for _, mac := range macs {
+				loc := Identity{ "@switch": sw, "@port": port, "@mac": mac }
+				idx[mac] = append(idx[mac], loc)
+			}
+		}
+	}
+
+	dbg(3, "db", "indexed %d MACs", len(idx))
+	db.macs = idx
+	return idx, nil
+}
+
+// mac_added records that the MAC of id was authorized on its port
+//
+// NB: db.mutex must be held
+func (db *DB) mac_added(id Identity) {
+	if db.macs == nil { return } // NB: not loaded yet
+
+	mac := id["@mac"]
+	for _, loc := range db.macs[mac] {
+		if loc["@switch"] == id["@switch"] && loc["@port"] == id["@port"] { return }
+	}
+
+	loc := Identity{ "@switch": id["@switch"], "@port": id["@port"], "@mac": mac }
+	db.macs[mac] = append(db.macs[mac], loc)
+}
+
+// mac_removed records that the MAC of id was removed from its port
+//
+// NB: db.mutex must be held
+func (db *DB) mac_removed(id Identity) {
+	if db.macs == nil { return }
+
+	mac := id["@mac"]
+	locs := []Identity{}
+	for _, loc := range db.macs[mac] {
+		if loc["@switch"] != id["@switch"] || loc["@port"] != id["@port"] { locs = append(locs, loc) }
+	}
+
+	if len(locs) > 0 { db.macs[mac] = locs } else { delete(db.macs, mac) }
+}
+
+// FindMac looks for the MAC of id on other switch ports, returns its location (or nil)
+//
+// NB: db.mutex must be held
+func (db *DB) FindMac(id Identity) (Identity, error) {
+	idx, err := db.mac_index()
+	if err != nil { return nil, err }
+
+	for _, loc := range idx[id["@mac"]] {
+		if loc["@switch"] == id["@switch"] && loc["@port"] == id["@port"] { continue }
+		return loc, nil
+	}
+
+	return nil, nil
+}
+
+// Moved checks if the MAC of id was moved from another switch port, see -mobility
+//
+// Returns the previous location (or nil), or err_mac_moved if moves are refused. The move
+// itself is logged by CarryOver(), and the refusal by the caller.
+// NB: db.mutex must be held
+func (db *DB) Moved(id Identity) (Identity, error) {
+	if db.S.opts.mobility == "off" { return nil, nil }
+
+	from, err := db.FindMac(id)
+	if err != nil || from == nil { return nil, err }
+
+	if db.S.opts.mobility == "deny" {
+		dbg(2, "db", "%s: MAC moved from %s: refused", db.Tag(id), db.Tag(from))
+		db.S.metrics.Inc("ap_mac_moved_total", labels("policy", "deny"))
+		return nil, err_mac_moved
+	}
+
+	return from, nil
+}
+
+// CarryOver moves the MAC directory of from - along with the identity baseline and its history -
+// to the location of id, replacing what AutoAdd() created
+//
+// NB: db.mutex must be held
+func (db *DB) CarryOver(from Identity, id Identity) error {
+	if err := db.st.Remove(db.MacPath(id)); err != nil { return err }
+	db.mac_removed(id)
+
+	dbg(2, "db", "%s: MAC moved from %s: carrying over identity", db.Tag(id), db.Tag(from))
+	if err := db.move_mac(from, id); err != nil { return err }
+
+	db.S.metrics.Inc("ap_mac_moved_total", labels("policy", "move"))
+	db.S.audit.Log("mac-moved", id, "", "", "from " + db.Tag(from))
+	db.S.events.Notify(NewEvent("revoke", from, "MAC moved to " + db.Tag(id)))
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+	"testing"
+)
+
+func TestFindMac(t *testing.T) {
+	S := &Server{}
+	S.opts.mobility = "deny"
+	st, err := NewFileStore(t.TempDir())
+	if err != nil { t.Fatal(err) }
+	S.db = &DB{ S: S, st: st }
+	db := S.db
+
+	mac := "00:11:22:33:44:55"
+	p1 := Identity{ "@switch": "sw1", "@port": "eth1", "@mac": mac }
+	p2 := Identity{ "@switch": "sw1", "@port": "eth2", "@mac": mac }
+	p3 := Identity{ "@switch": "sw2", "@port": "eth1", "@mac": mac }
+
+	// NB: loaded from the store
+	if err := st.Mkdir(db.MacPath(p1)); err != nil { t.Fatal(err) }
+	if loc, err := db.FindMac(p2); err != nil || db.Tag(loc) != db.Tag(p1) { t.Errorf("load: got %v (%v)", loc, err) }
+	if loc, _ := db.FindMac(p1); loc != nil { t.Errorf("same port: got %v", loc) }
+
+	if _, err := db.Moved(p2); err != err_mac_moved { t.Errorf("deny: got %v", err) }
+
+	// NB: kept up to date
+	if err := db.MoveMac(p1, p3); err != nil { t.Fatal(err) }
+	if loc, _ := db.FindMac(p2); db.Tag(loc) != db.Tag(p3) { t.Errorf("move: got %v", loc) }
+
+	if err := db.DelMac(p3); err != nil { t.Fatal(err) }
+	if loc, _ := db.FindMac(p2); loc != nil { t.Errorf("delete: got %v", loc) }
+
+	S.opts.mobility = "move"
+	if err := db.AddMac(p1); err != nil { t.Fatal(err) }
+	if from, err := db.Moved(p2); err != nil || db.Tag(from) != db.Tag(p1) { t.Errorf("move: got %v (%v)", from, err) }
+}
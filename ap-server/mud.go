@@ -0,0 +1,280 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	PF_MUD = "_mud"    // MUD profiles cache: profiles/_mud/<escaped MUD URL>/profile.json
+	ID_MUD = "mud-url" // identity key with the MUD URL
+)
+
+var (
+	err_mud_json = errors.New("not a MUD file")
+)
+
+// MUD file, RFC 8520 (only the parts we need)
+type Mud struct {
+	Mud struct {
+		Url    string    `json:"mud-url"`
+		From   MudPolicy `json:"from-device-policy"`
+		To     MudPolicy `json:"to-device-policy"`
+	} `json:"ietf-mud:mud"`
+
+	Acls struct {
+		Acl []MudAcl `json:"acl"`
+	} `json:"ietf-access-control-list:acls"`
+}
+
+type MudPolicy struct {
+	AccessLists struct {
+		AccessList []struct {
+			Name string `json:"name"`
+		} `json:"access-list"`
+	} `json:"access-lists"`
+}
+
+type MudAcl struct {
+	Name string `json:"name"`
+	Aces struct {
+		Ace []MudAce `json:"ace"`
+	} `json:"aces"`
+}
+
+type MudAce struct {
+	Name    string                            `json:"name"`
+	Matches map[string]map[string]interface{} `json:"matches"`
+	Actions struct {
+		Forwarding string `json:"forwarding"`
+	} `json:"actions"`
+}
+
+// AuthorizeMud fetches the MUD file for given identity and translates it into a profile
+//
+// The MUD file goes through the same cache and signature checks as manufacturer profiles,
+// see Fetch(). The keys of the device manufacturer are used, if any.
+func (db *DB) AuthorizeMud(id Identity) (Profile, error) {
+	tag := "db: " + db.Tag(id)
+
+	url := id[ID_MUD]
+	if !db.S.http_url(url) { return nil, fmt.Errorf("invalid MUD URL: %s", url) }
+
+	qstring := PF_MUD + "/" + escape(url)
+	pfpath := db.ProfilePath(qstring, "profile.json")
+	manufacturer := escape(db.QueryValue(id, 0))
+
+	// is it in memory?
+	if entry, ok := db.S.cache.Peek(url); ok && entry.status == http.StatusOK {
+		db.S.metrics.Inc("ap_profile_cache_total", labels("result", "hit"))
+		return entry.Profile(), nil
+	}
+
+	// fetch it (or revalidate) & store on disk
+	entry := db.S.cache.Fetch(url, func(old *PfEntry) *PfEntry {
+		return db.fetch(id, manufacturer, qstring, url, old, func(mudbytes []byte) (Profile, error) {
+			var mud Mud
+			if err := json.Unmarshal(mudbytes, &mud); err != nil { return nil, err }
+			if len(mud.Mud.Url) == 0 { return nil, err_mud_json }
+
+			pf, err := db.S.NewMudProfile(&mud, url)
+			if err != nil { return nil, err }
+
+			if u, ok := pf["@mud_unsupported"].([]string); ok {
+				db.S.audit.Log("mud-unsupported", id, "", url, strings.Join(u, "; "))
+			}
+			return pf, nil
+		})
+	})
+
+	err := entry.err
+	switch {
+	case err != nil:
+		break
+	case entry.status == http.StatusNotFound:
+		err = fmt.Errorf("HTTP status %d", entry.status)
+		if _, err2 := db.st.Stat(pfpath); err2 == nil {
+			dbg(3, tag, "removing local copy of MUD profile, %s", pfpath)
+			db.S.audit.Log("profile-removed", id, "", url, err.Error())
+			db.st.Remove(pfpath)
+		}
+	default:
+		return entry.Profile(), nil
+	}
+	dbg(2, tag, "MUD error: %s", err)
+
+	// use the stored copy if possible (NB: verified when fetched)
+	if _, err2 := db.st.Stat(pfpath); err2 == nil { return db.ReadProfileAt(qstring) }
+	return nil, err
+}
+
+// NewMudProfile translates the MUD ACLs into from_device/to_device rules
+//
+// Accepted ACEs become the allow list, and the rest becomes the block list; as MUD is
+// deny-by-default, allow is always set. Constructs that can't be represented (e.g. DNS names,
+// MUD abstractions like "controller", direction-initiated, or mixed source/destination matches)
+// are skipped and reported in @mud_unsupported.
+func (S *Server) NewMudProfile(mud *Mud, src string) (Profile, error) {
+	acls := make(map[string]*MudAcl)
+	for i := range mud.Acls.Acl { acls[mud.Acls.Acl[i].Name] = &mud.Acls.Acl[i] }
+
+	in := make(map[string]interface{})
+	var unsupported []string
+
+	for _, pol := range []struct{ key string; remote string; policy *MudPolicy }{
+		{ "from_device", "dst", &mud.Mud.From },
+		{ "to_device", "src", &mud.Mud.To },
+	} {
+		allow, block := []interface{}{}, []interface{}{}
+
+		for _, al := range pol.policy.AccessLists.AccessList {
+			acl, ok := acls[al.Name]
+			if !ok {
+				unsupported = append(unsupported, fmt.Sprintf("%s: ACL not found", al.Name))
+				continue
+			}
+
+			for _, ace := range acl.Aces.Ace {
+				spec, err := mud_ace(&ace, pol.remote)
+				if err != nil {
+					unsupported = append(unsupported, fmt.Sprintf("%s/%s: %s", acl.Name, ace.Name, err))
+					continue
+				}
+
+				if ace.Actions.Forwarding == "accept" {
+					allow = append(allow, spec)
+				} else {
+					block = append(block, spec)
+				}
+			}
+		}
+
+		rules := map[string]interface{}{ "allow": allow }
+		if len(block) > 0 { rules["block"] = block }
+		in[pol.key] = rules
+	}
+
+	pf, err := S.NewProfile(in, src)
+	if err != nil { return nil, err }
+
+	if len(unsupported) > 0 {
+		dbg(2, "mud", "%s: unsupported constructs: %s", src, strings.Join(unsupported, "; "))
+		pf["@mud_unsupported"] = unsupported
+	}
+
+	return pf, nil
+}
+
+// mud_ace translates a MUD ACE into a service spec, as understood by ap-switch tc_services_parse
+func mud_ace(ace *MudAce, remote string) (string, error) {
+	var dir, prefix, proto, ports string
+
+	for kind, m := range ace.Matches {
+		switch kind {
+		case "ipv4", "ipv6":
+			for k, v := range m {
+				switch k {
+				case "protocol":
+					n, ok := v.(float64)
+					if !ok { return "", fmt.Errorf("%s: invalid value", k) }
+					switch n {
+					case 1:   proto = "icmp"
+					case 6:   proto = "tcp"
+					case 17:  proto = "udp"
+					case 58:  proto = "icmpv6"
+					case 132: proto = "sctp"
+					default:  proto = fmt.Sprintf("%d", int(n))
+					}
+
+				case "destination-ipv4-network", "destination-ipv6-network",
+				     "source-ipv4-network", "source-ipv6-network":
+					d := "dst"
+					if strings.HasPrefix(k, "source") { d = "src" }
+					if len(dir) > 0 && dir != d { return "", fmt.Errorf("%s: mixed directions", k) }
+					dir, prefix = d, fmt.Sprintf("%v", v)
+
+				default: // e.g. ietf-acldns:dst-dnsname
+					return "", fmt.Errorf("%s: not supported", k)
+				}
+			}
+
+		case "tcp", "udp":
+			if len(proto) == 0 { proto = kind }
+			for k, v := range m {
+				switch k {
+				case "destination-port", "source-port":
+					d := "dst"
+					if k == "source-port" { d = "src" }
+					if len(dir) > 0 && dir != d { return "", fmt.Errorf("%s: mixed directions", k) }
+					dir = d
+
+					p, err := mud_port(v)
+					if err != nil { return "", fmt.Errorf("%s: %s", k, err) }
+					ports = p
+
+				case "ietf-mud:direction-initiated":
+					// NB: stateless filtering, can't check who initiated - and skipping the match
+					// would widen the ACE to both directions
+					return "", fmt.Errorf("%s/%s: not supported", kind, k)
+
+				default:
+					return "", fmt.Errorf("%s/%s: not supported", kind, k)
+				}
+			}
+
+		default: // e.g. ietf-mud:mud, eth
+			return "", fmt.Errorf("%s: not supported", kind)
+		}
+	}
+
+	// the remote end by default
+	if len(dir) == 0 { dir = remote }
+	if len(prefix) == 0 { prefix = "*" }
+
+	spec := []string{ dir, prefix }
+	if len(proto) > 0 {
+		spec = append(spec, proto)
+		if len(ports) > 0 { spec = append(spec, ports) }
+	} else if len(ports) > 0 {
+		return "", errors.New("ports without protocol")
+	}
+
+	return strings.Join(spec, " "), nil
+}
+
+func mud_port(v interface{}) (string, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok { return "", errors.New("invalid value") }
+
+	op, _ := m["operator"].(string)
+	switch {
+	case len(op) == 0 && m["lower-port"] != nil: // range
+		return fmt.Sprintf("%v-%v", m["lower-port"], m["upper-port"]), nil
+	case op == "eq":
+		return fmt.Sprintf("%v", m["port"]), nil
+	default:
+		return "", fmt.Errorf("operator '%s' not supported", op)
+	}
+}
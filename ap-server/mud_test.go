@@ -0,0 +1,56 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMudAce(t *testing.T) {
+	tests := []struct {
+		matches map[string]map[string]interface{}
+		want    string // empty: not supported
+	}{
+		{ map[string]map[string]interface{}{
+			"ipv4": { "protocol": 6.0, "destination-ipv4-network": "10.0.0.0/8" },
+			"tcp":  { "destination-port": map[string]interface{}{ "operator": "eq", "port": 443.0 } },
+		}, "dst 10.0.0.0/8 tcp 443" },
+		{ map[string]map[string]interface{}{
+			"udp": { "source-port": map[string]interface{}{ "lower-port": 1000.0, "upper-port": 2000.0 } },
+		}, "src * udp 1000-2000" },
+		{ map[string]map[string]interface{}{
+			"tcp": { "ietf-mud:direction-initiated": "from-device" },
+		}, "" },
+		{ map[string]map[string]interface{}{
+			"ipv4": { "ietf-acldns:dst-dnsname": "example.com" },
+		}, "" },
+	}
+
+	for i, tt := range tests {
+		got, err := mud_ace(&MudAce{ Matches: tt.matches }, "dst")
+		switch {
+		case len(tt.want) == 0 && err == nil:
+			t.Errorf("%d: got %q, want error", i, got)
+		case len(tt.want) > 0 && (err != nil || got != tt.want):
+			t.Errorf("%d: got %q (%v), want %q", i, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"os"
+	"strings"
+)
+
+// OUI maps MAC address prefixes (upper-case hex, no separators) to vendor names
+type OUI map[string]string
+
+// words ignored when comparing vendor names
+var oui_stopwords = map[string]bool{
+	"inc": true, "ltd": true, "llc": true, "co": true, "corp": true, "corporation": true,
+	"gmbh": true, "ag": true, "sa": true, "bv": true, "limited": true, "company": true,
+	"technology": true, "technologies": true, "electronics": true, "the": true,
+}
+
+// NewOUI reads the IEEE registry, either in CSV (oui.csv, mam.csv, oui36.csv) or oui.txt format
+func NewOUI(path string) (OUI, error) {
+	fh, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer fh.Close()
+
+	oui := make(OUI)
+	rd := bufio.NewReader(fh)
+
+	// sniff the format
+	head, err := rd.Peek(8)
+	if err != nil && err != io.EOF { return nil, err }
+
+	if strings.HasPrefix(string(head), "Registry") {
+		err = oui.readCSV(rd)
+	} else {
+		err = oui.readTxt(rd)
+	}
+
+	return oui, err
+}
+
+// readCSV reads "Registry,Assignment,Organization Name,Organization Address"
+func (oui OUI) readCSV(rd io.Reader) error {
+	r := csv.NewReader(rd)
+	r.FieldsPerRecord = -1
+
+	for first := true; ; first = false {
+		rec, err := r.Read()
+		if err == io.EOF { break }
+		if err != nil { return err }
+		if first || len(rec) < 3 { continue }
+
+		oui.add(rec[1], rec[2])
+	}
+
+	return nil
+}
+
+// readTxt reads lines like "00-22-72   (hex)		American Micro-Fuel Device Corp."
+func (oui OUI) readTxt(rd io.Reader) error {
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		line := sc.Text()
+		i := strings.Index(line, "(hex)")
+		if i < 0 { continue }
+
+		oui.add(line[:i], line[i+5:])
+	}
+
+	return sc.Err()
+}
+
+func (oui OUI) add(prefix string, vendor string) {
+	prefix = strings.ToUpper(strings.NewReplacer("-", "", ":", "", " ", "").Replace(prefix))
+	vendor = strings.TrimSpace(vendor)
+	if len(prefix) < 6 || len(vendor) == 0 { return }
+
+	oui[prefix] = vendor
+}
+
+// Lookup returns the vendor for given MAC address, using the longest matching prefix
+func (oui OUI) Lookup(mac string) (string, bool) {
+	hex := strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+
+	for _, l := range []int{ 9, 7, 6 } { // MA-S, MA-M, MA-L
+		if len(hex) < l { continue }
+		if v, ok := oui[hex[:l]]; ok { return v, true }
+	}
+
+	return "", false
+}
+
+// vendor_match returns true if manufacturer name looks like the vendor name
+func vendor_match(manufacturer string, vendor string) bool {
+	words := make(map[string]bool)
+	for _, w := range strings.Split(escape(vendor), "_") {
+		if len(w) > 0 && !oui_stopwords[w] { words[w] = true }
+	}
+
+	for _, w := range strings.Split(escape(manufacturer), "_") {
+		if words[w] { return true }
+	}
+
+	return false
+}
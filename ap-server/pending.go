@@ -0,0 +1,208 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	DB_PENDING = "pending" // unknown MACs waiting for approval (with -auto=false)
+
+	PENDING_RETRY = 5 // how often the switch should retry (in seconds)
+)
+
+var (
+	err_pending = errors.New("MAC address pending approval")
+	err_rejected = errors.New("MAC address rejected by the administrator")
+)
+
+// Pending is an entry in the approval queue
+type Pending struct {
+	State    string    `json:"state"` // pending or rejected
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Count    int       `json:"count"`
+	Identity Identity  `json:"identity"`             // as presented by the device
+	From     Identity  `json:"from,omitempty"`       // previous location, if the MAC moved
+}
+
+func (db *DB) PendingPath(id Identity) string {
+	return fmt.Sprintf("%s/%s/%s/%s.json", DB_PENDING, id["@switch"], id["@port"], id["@mac"])
+}
+
+func (db *DB) read_pending(path string) (*Pending, error) {
+	jsonb, err := db.st.Read(path)
+	if err != nil { return nil, err }
+
+	p := &Pending{}
+	if err := json.Unmarshal(jsonb, p); err != nil { return nil, fmt.Errorf("%s: %s", path, err) }
+	return p, nil
+}
+
+func (db *DB) write_pending(path string, p *Pending) error {
+	jsonb, err := json.MarshalIndent(p, "", "\t")
+	if err != nil { return err }
+	return db.st.Write(path, jsonb)
+}
+
+// AddPending puts an unknown MAC in the approval queue, along with the identity it presented
+//
+// Returns err_pending, or err_rejected if the administrator already rejected it.
+func (db *DB) AddPending(id Identity) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	path := db.PendingPath(id)
+	now := time.Now().UTC()
+
+	p, err := db.read_pending(path)
+	switch {
+	case err == nil:
+		if p.State == "rejected" { return err_rejected }
+	case os.IsNotExist(err):
+		dbg(1, "db", "%s: new MAC waiting for approval", db.Tag(id))
+		p = &Pending{ State: "pending", First: now }
+	default:
+		return err
+	}
+
+	p.Last, p.Identity = now, id
+	p.Count++
+
+	// seen on another port? NB: Approve() will carry over the identity baseline
+	if db.S.opts.mobility != "off" {
+		if p.From, err = db.FindMac(id); err != nil { return err }
+	}
+
+	if err := db.write_pending(path, p); err != nil { return err }
+	return err_pending
+}
+
+// ListPending returns all entries in the approval queue
+func (db *DB) ListPending() ([]Pending, error) {
+	ret := []Pending{}
+	err := WalkStore(db.st, DB_PENDING, func(path string, jsonb []byte) error {
+		var p Pending
+		if err := json.Unmarshal(jsonb, &p); err != nil { return fmt.Errorf("%s: %s", path, err) }
+		ret = append(ret, p)
+		return nil
+	})
+	return ret, err
+}
+
+// Approve authorizes a pending MAC on its switch port, and removes it from the queue
+//
+// If the MAC is authorized on another port, it's moved along with its identity baseline - or
+// refused with err_mac_moved, depending on -mobility.
+func (db *DB) Approve(id Identity) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	path := db.PendingPath(id)
+	if _, err := db.st.Stat(path); err != nil { return err }
+
+	// NB: check again, the MAC could have been changed since queued
+	from, err := db.Moved(id)
+	if err != nil { return err }
+
+	dbg(1, "db", "%s: MAC approved", db.Tag(id))
+	if err := db.st.Mkdir(db.MacPath(id)); err != nil { return err }
+	db.mac_added(id)
+	if from != nil {
+		if err := db.CarryOver(from, id); err != nil { return err }
+	}
+	return db.st.Remove(path)
+}
+
+// Reject marks a pending MAC as rejected, so that it's denied from now on
+func (db *DB) Reject(id Identity) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	path := db.PendingPath(id)
+	p, err := db.read_pending(path)
+	if err != nil { return err }
+
+	dbg(1, "db", "%s: MAC rejected", db.Tag(id))
+	p.State = "rejected"
+	return db.write_pending(path, p)
+}
+
+// DelPending removes given MAC from the queue (so that it's queued again on next request)
+func (db *DB) DelPending(id Identity) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	path := db.PendingPath(id)
+	if _, err := db.st.Stat(path); err != nil { return err }
+	return db.st.Remove(path)
+}
+
+func (a *Api) ListPending(ar *ApiRequest) *ApiRequest {
+	ret, err := a.S.db.ListPending()
+	if os.IsNotExist(err) { ret, err = []Pending{}, nil }
+	if err != nil { return ar.Err(db_status(err), "listing pending MACs failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+func (a *Api) ApprovePending(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	err = a.S.db.Approve(id)
+	if err != nil { return ar.Err(db_status(err), "approving MAC failed", err.Error()) }
+
+	a.S.audit.Log("approve", id, "allow", "", "approved by the administrator")
+	a.S.events.Notify(NewEvent("reauth", id, "MAC approved"))
+	ar.out = id
+	return ar
+}
+
+func (a *Api) RejectPending(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	err = a.S.db.Reject(id)
+	if err != nil { return ar.Err(db_status(err), "rejecting MAC failed", err.Error()) }
+
+	a.S.audit.Log("reject", id, "deny", "", "rejected by the administrator")
+	a.S.events.Notify(NewEvent("revoke", id, "MAC rejected"))
+	ar.out = id
+	return ar
+}
+
+func (a *Api) DelPending(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	err = a.S.db.DelPending(id)
+	if err != nil { return ar.Err(db_status(err), "deleting pending MAC failed", err.Error()) }
+
+	ar.out = id
+	return ar
+}
@@ -22,17 +22,39 @@ package main
 import (
 	"time"
 	"io/ioutil"
-	"os"
+	"io"
 	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PF_RATE_MAX = 100000 // max. bit-rate in Mbit/s
 )
 
 type Profile map[string]interface{}
 
+// ProfileError maps profile fields to what's wrong with them
+type ProfileError map[string]string
+
+func (pe ProfileError) Error() string {
+	var keys []string
+	for k := range pe { keys = append(keys, k) }
+	sort.Strings(keys)
+
+	var msgs []string
+	for _, k := range keys { msgs = append(msgs, k + ": " + pe[k]) }
+	return "invalid profile: " + strings.Join(msgs, "; ")
+}
+
 func (S *Server) NewProfile(in map[string]interface{}, source string) (pf Profile, err error) {
 	if in == nil {
 		pf = make(Profile)
 	} else {
-		// TODO: should verify?
+		if err = VerifyProfile(in); err != nil { return nil, err }
 		pf = in
 	}
 
@@ -43,15 +65,173 @@ func (S *Server) NewProfile(in map[string]interface{}, source string) (pf Profil
     return
 }
 
-func (S *Server) ReadProfile(fh *os.File) (Profile, error) {
+// NewLocalProfile converts administrator input into a local profile, dropping internal keys
+func (S *Server) NewLocalProfile(in map[string]interface{}) (Profile, error) {
+	for k := range in {
+		if len(k) == 0 || k[0] == '@' { delete(in, k) }
+	}
+
+	pf, err := S.NewProfile(in, "local")
+	if err != nil { return nil, err }
+	pf["@local"] = true
+
+	return pf, nil
+}
+
+func (S *Server) ReadProfile(fh io.Reader) (Profile, error) {
 	pf := make(map[string]interface{})
 
 	jsonb, err := ioutil.ReadAll(fh)
 	if err != nil { return pf, err }
 
-	// NB: no verification
 	err = json.Unmarshal(jsonb, &pf)
-	return pf, err
+	if err != nil { return pf, err }
+
+	return pf, VerifyProfile(pf)
+}
+
+// VerifyProfile checks the profile against what ap-switch can provision
+func VerifyProfile(pf map[string]interface{}) error {
+	pe := make(ProfileError)
+
+	for k, vi := range pf {
+		// internal key, ignore
+		if len(k) > 0 && k[0] == '@' { continue }
+
+		switch k {
+		case "from_device", "to_device":
+			rules, ok := vi.(map[string]interface{})
+			if !ok { pe[k] = fmt.Sprintf("not an object: %v (%T)", vi, vi); break }
+			verify_rules(pe, k, rules)
+		default:
+			pe[k] = "unknown key"
+		}
+	}
+
+	if len(pe) > 0 { return pe }
+	return nil
+}
+
+func verify_rules(pe ProfileError, prefix string, rules map[string]interface{}) {
+	for k, vi := range rules {
+		key := prefix + "." + k
+
+		switch k {
+		case "rate":
+			rate, err := profile_rate(vi)
+			switch {
+			case err != nil:
+				pe[key] = err.Error()
+			case rate <= 0 || rate != rate || rate > PF_RATE_MAX:
+				pe[key] = fmt.Sprintf("out of range (0, %d]: %v", PF_RATE_MAX, rate)
+			}
+
+		case "allow", "block":
+			if err := verify_services(vi); err != nil { pe[key] = err.Error() }
+
+		default:
+			pe[key] = "unknown key"
+		}
+	}
+}
+
+// profile_rate returns the bit-rate value of a rate rule
+func profile_rate(vi interface{}) (float64, error) {
+	switch v := vi.(type) {
+	case float64: return v, nil
+	case string:  return strconv.ParseFloat(v, 64)
+	default:      return 0, fmt.Errorf("not a number: %v (%T)", v, v)
+	}
+}
+
+// service_specs returns the list of service specs in an allow or block value
+func service_specs(bi interface{}) ([]string, error) {
+	specs := []string{}
+
+	switch v := bi.(type) {
+	case nil: // empty?
+		break
+	case string:
+		specs = append(specs, v)
+	case []interface{}:
+		for _, vi := range v {
+			switch v2 := vi.(type) {
+			case string:
+				specs = append(specs, v2)
+			default:
+				return nil, fmt.Errorf("invalid element: %v (%T)", v2, v2)
+			}
+		}
+	case []string:
+		specs = append(specs, v...)
+	default:
+		return nil, fmt.Errorf("invalid value: %v (%T)", v, v)
+	}
+
+	return specs, nil
+}
+
+// verify_services follows the service-spec grammar of ap-switch tc_services_parse:
+// "[<dir> <prefix|*> [<proto> [<port,port-port,...>]]]" or just "<proto>"
+func verify_services(bi interface{}) error {
+	specs, err := service_specs(bi)
+	if err != nil { return err }
+
+	for _, b := range specs {
+		var dir, prefix, tp, ports string
+
+		d := strings.Split(b, " ")
+		switch len(d) {
+		case 1: tp = d[0]
+		case 4: ports = d[3]; fallthrough
+		case 3: tp = d[2]; fallthrough
+		case 2: prefix = d[1]; dir = d[0]
+		default: return fmt.Errorf("invalid number of tokens in %s", b)
+		}
+
+		// direction
+		switch dir {
+		case "", "src", "dst": break
+		default: return fmt.Errorf("invalid direction '%s' in %s", dir, b)
+		}
+
+		// IP prefix
+		if len(prefix) > 1 {
+			if strings.IndexByte(prefix, '/') > 0 {
+				if _, _, err := net.ParseCIDR(prefix); err != nil {
+					return fmt.Errorf("invalid IP prefix '%s' in %s: %s", prefix, b, err)
+				}
+			} else if net.ParseIP(prefix) == nil {
+				return fmt.Errorf("invalid IP address '%s' in %s", prefix, b)
+			}
+		}
+
+		// transport protocol
+		switch tp {
+		case "", "tcp", "udp", "sctp", "icmp", "icmpv6": break
+		default:
+			if _, err := strconv.ParseUint(tp, 0, 8); err != nil {
+				return fmt.Errorf("invalid protocol '%s' in %s", tp, b)
+			}
+		}
+
+		// ports
+		for _, p := range strings.Split(ports, ",") {
+			p = strings.TrimSpace(p)
+			if len(p) == 0 { continue }
+
+			var err error
+			if i := strings.IndexByte(p, '-'); i > 0 && i < len(p)-1 {
+				_, err = strconv.ParseUint(p[0:i], 0, 16)
+				if err == nil { _, err = strconv.ParseUint(p[i+1:], 0, 16) }
+			} else {
+				_, err = strconv.ParseUint(p, 0, 16)
+			}
+			if err != nil { return fmt.Errorf("invalid port '%s' in %s: %s", p, b, err) }
+		}
+	}
+
+	return nil
 }
 
 func (pf *Profile) JSON() ([]byte, error) {
@@ -0,0 +1,71 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestVerifyServices(t *testing.T) {
+	tests := []struct {
+		in interface{}
+		ok bool
+	}{
+		{ nil, true },
+		{ "tcp", true },
+		{ "dst 10.0.0.0/8", true },
+		{ "src * udp 53,67-68", true },
+		{ []interface{}{ "dst 1.2.3.4 tcp 443", "icmp" }, true },
+		{ []string{ "dst ::1 6 22" }, true },
+		{ "up 10.0.0.1", false },
+		{ "dst 10.0.0.0/33", false },
+		{ "dst 300.0.0.1", false },
+		{ "dst * gre", false },
+		{ "dst * tcp 70000", false },
+		{ "dst * tcp 80 extra", false },
+		{ []interface{}{ "tcp", 53.0 }, false },
+		{ 53.0, false },
+	}
+
+	for _, tt := range tests {
+		err := verify_services(tt.in)
+		if tt.ok && err != nil { t.Errorf("%#v: %s", tt.in, err) }
+		if !tt.ok && err == nil { t.Errorf("%#v: expected an error", tt.in) }
+	}
+}
+
+func TestVerifyProfile(t *testing.T) {
+	ok := map[string]interface{}{
+		"@source": "local",
+		"from_device": map[string]interface{}{ "rate": "1.5", "allow": "udp" },
+		"to_device": map[string]interface{}{ "rate": 100.0, "block": []interface{}{ "tcp" } },
+	}
+	if err := VerifyProfile(ok); err != nil { t.Errorf("valid profile: %s", err) }
+
+	bad := map[string]interface{}{
+		"to_device": map[string]interface{}{ "rate": 0.0, "bogus": true },
+		"extra": 1,
+	}
+	pe, is_pe := VerifyProfile(bad).(ProfileError)
+	if !is_pe { t.Fatalf("expected ProfileError") }
+	for _, k := range []string{ "to_device.rate", "to_device.bogus", "extra" } {
+		if _, ok := pe[k]; !ok { t.Errorf("%s: error not reported: %v", k, pe) }
+	}
+}
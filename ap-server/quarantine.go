@@ -0,0 +1,184 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DB_REVIEW = "review" // quarantined devices, for review by the administrator
+)
+
+// events that can lead to quarantine instead of deny, see -quarantine
+var quarantine_events = map[string]error{
+	"downgrade":   err_downgrade,
+	"unknown-mac": err_unknown_mac,
+	"mac-moved":   err_mac_moved,
+}
+
+// Review is an entry on the admin review list
+type Review struct {
+	Reason   string    `json:"reason"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Count    int       `json:"count"`
+	Identity Identity  `json:"identity"`
+}
+
+// parse_quarantine parses the -quarantine option, e.g. "downgrade,unknown-mac"
+//
+// NB: with -auto=false, unknown MACs go to the approval queue (err_pending) instead, and
+// waiting for approval takes precedence: the switch keeps retrying until the administrator
+// decides, see Api.Authorize(). Hence unknown-mac applies only to MACs that couldn't be
+// auto-added, see port security.
+func parse_quarantine(opt string) (map[error]bool, error) {
+	ret := make(map[error]bool)
+	for _, ev := range strings.Split(opt, ",") {
+		ev = strings.TrimSpace(ev)
+		if len(ev) == 0 { continue }
+
+		err, ok := quarantine_events[ev]
+		if !ok { return nil, fmt.Errorf("invalid event: %s", ev) }
+		ret[err] = true
+	}
+	return ret, nil
+}
+
+func (db *DB) ReviewPath(id Identity) string {
+	return fmt.Sprintf("%s/%s/%s/%s.json", DB_REVIEW, id["@switch"], id["@port"], id["@mac"])
+}
+
+// AddReview puts given device on the review list (or updates its entry)
+func (db *DB) AddReview(id Identity, reason string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	path := db.ReviewPath(id)
+	now := time.Now().UTC()
+
+	var r Review
+	jsonb, err := db.st.Read(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(jsonb, &r); err != nil { return err }
+	case os.IsNotExist(err):
+		r.First = now
+	default:
+		return err
+	}
+
+	r.Reason, r.Last, r.Identity = reason, now, id
+	r.Count++
+
+	jsonb, err = json.MarshalIndent(&r, "", "\t")
+	if err != nil { return err }
+	return db.st.Write(path, jsonb)
+}
+
+// ListReview returns all entries on the review list
+func (db *DB) ListReview() ([]Review, error) {
+	ret := []Review{}
+	err := WalkStore(db.st, DB_REVIEW, func(path string, jsonb []byte) error {
+		var r Review
+		if err := json.Unmarshal(jsonb, &r); err != nil { return fmt.Errorf("%s: %s", path, err) }
+		ret = append(ret, r)
+		return nil
+	})
+	return ret, err
+}
+
+// DelReview removes given device from the review list
+func (db *DB) DelReview(id Identity) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	path := db.ReviewPath(id)
+	if _, err := db.st.Stat(path); err != nil { return err }
+
+	dbg(1, "db", "%s: removing from review list", db.Tag(id))
+	return db.st.Remove(path)
+}
+
+func (a *Api) GetQuarantine(ar *ApiRequest) *ApiRequest {
+	pf, err := a.S.db.ReadProfileAt(PF_QUARANTINE)
+	if err != nil { return ar.Err(db_status(err), "reading quarantine profile failed", err.Error()) }
+
+	ar.out = pf
+	return ar
+}
+
+// PutQuarantine stores the quarantine profile given in input JSON
+func (a *Api) PutQuarantine(ar *ApiRequest) *ApiRequest {
+	input, ok := ar.in.(map[string]interface{})
+	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
+
+	pf, err := a.S.db.WriteProfile(PF_QUARANTINE, input, false)
+	switch {
+	case err == nil:
+		break
+	case pf == nil:
+		if pe, ok := err.(ProfileError); ok {
+			return ar.Err(http.StatusBadRequest, "invalid profile", pe)
+		}
+		return ar.Err(http.StatusBadRequest, "invalid profile", err.Error())
+	default:
+		return ar.Err(db_status(err), "storing quarantine profile failed", err.Error())
+	}
+
+	a.S.events.Notify(NewEvent("reauth", nil, "quarantine profile changed"))
+
+	ar.out = pf
+	return ar
+}
+
+func (a *Api) DelQuarantine(ar *ApiRequest) *ApiRequest {
+	err := a.S.db.DelProfile(PF_QUARANTINE)
+	if err != nil { return ar.Err(db_status(err), "deleting quarantine profile failed", err.Error()) }
+	a.S.events.Notify(NewEvent("reauth", nil, "quarantine profile deleted"))
+
+	ar.out = map[string]interface{}{}
+	return ar
+}
+
+func (a *Api) ListReview(ar *ApiRequest) *ApiRequest {
+	ret, err := a.S.db.ListReview()
+	if os.IsNotExist(err) { ret, err = []Review{}, nil }
+	if err != nil { return ar.Err(db_status(err), "listing review list failed", err.Error()) }
+
+	ar.out = ret
+	return ar
+}
+
+func (a *Api) DelReview(ar *ApiRequest) *ApiRequest {
+	id, err := ar.ParamId()
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid MAC", err.Error()) }
+
+	err = a.S.db.DelReview(id)
+	if err != nil { return ar.Err(db_status(err), "deleting review entry failed", err.Error()) }
+
+	ar.out = id
+	return ar
+}
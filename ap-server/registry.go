@@ -0,0 +1,222 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REG_INTERVAL = 30      // default heartbeat interval (in seconds)
+	REG_INTERVAL_MAX = 300 // max. heartbeat interval accepted from a switch (in seconds)
+	REG_STALE = 3          // switch is stale after that many missed heartbeats
+)
+
+// Registry is the live view of switches, as reported by ap-switch
+type Registry struct {
+	mutex    sync.Mutex
+	switches map[string]*SwitchInfo
+}
+
+type SwitchInfo struct {
+	Name       string        `json:"name"`
+	Version    string        `json:"version"`
+	Ifaces     []string      `json:"ifaces"`
+	Interval   int           `json:"interval"` // heartbeat interval (in seconds, see Register)
+	Addr       string        `json:"addr"`     // last remote address
+	Registered time.Time     `json:"registered"`
+	LastSeen   time.Time     `json:"last_seen"`
+	Status     string        `json:"status"`   // online or stale
+	States     []SwitchState `json:"states,omitempty"`
+}
+
+// SwitchState is a port-MAC state enforced by a switch
+type SwitchState struct {
+	Port   string    `json:"port"`
+	Mac    string    `json:"mac"`
+	State  string    `json:"state"`            // e.g. on, off, in-authz
+	LastIP string    `json:"lastip"`
+	Age    float64   `json:"age,omitempty"`    // seconds in that state, as reported
+	Since  time.Time `json:"since"`
+	Source string    `json:"source,omitempty"` // profile source in use
+}
+
+func NewRegistry() *Registry {
+	return &Registry{ switches: make(map[string]*SwitchInfo) }
+}
+
+// status updates the switch status given the current time
+func (sw *SwitchInfo) status(now time.Time) {
+	stale := time.Duration(REG_STALE * sw.Interval) * time.Second
+	if now.Sub(sw.LastSeen) > stale {
+		if sw.Status != "stale" { dbg(1, "registry", "%s: stale, last seen %s", sw.Name, sw.LastSeen) }
+		sw.Status = "stale"
+	} else {
+		sw.Status = "online"
+	}
+}
+
+// Register (re-)adds switch info, replacing the previous state table
+//
+// NB: the heartbeat interval is clamped to REG_INTERVAL_MAX, so that a switch can't stay
+// online without reporting
+func (r *Registry) Register(info *SwitchInfo) {
+	now := time.Now().UTC()
+	info.Registered, info.LastSeen, info.States = now, now, nil
+	switch {
+	case info.Interval <= 0:
+		info.Interval = REG_INTERVAL
+	case info.Interval > REG_INTERVAL_MAX:
+		dbg(1, "registry", "%s: heartbeat interval %ds too long, using %ds",
+			info.Name, info.Interval, REG_INTERVAL_MAX)
+		info.Interval = REG_INTERVAL_MAX
+	}
+
+	r.mutex.Lock()
+	r.switches[info.Name] = info
+	r.mutex.Unlock()
+}
+
+// Report updates the state table of given switch, returns false if it's not registered
+func (r *Registry) Report(name string, addr string, states []SwitchState) bool {
+	now := time.Now().UTC()
+	for i := range states {
+		states[i].Since = now.Add(-time.Duration(states[i].Age * 1e9)).Truncate(time.Second)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sw, ok := r.switches[name]
+	if !ok { return false }
+
+	if sw.Status == "stale" { dbg(1, "registry", "%s: back online", name) }
+	sw.Addr, sw.LastSeen, sw.States, sw.Status = addr, now, states, "online"
+	return true
+}
+
+// List returns copies of all switch infos (without state tables if !states)
+func (r *Registry) List(states bool) []SwitchInfo {
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ret := []SwitchInfo{}
+	for _, sw := range r.switches {
+		sw.status(now)
+		info := *sw
+		if !states { info.States = nil }
+		ret = append(ret, info)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// Get returns a copy of given switch info
+func (r *Registry) Get(name string) (SwitchInfo, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sw, ok := r.switches[name]
+	if !ok { return SwitchInfo{}, false }
+
+	sw.status(time.Now())
+	return *sw, true
+}
+
+// registry_input decodes input JSON into out
+func registry_input(ar *ApiRequest, out interface{}) error {
+	jsonb, err := json.Marshal(ar.in)
+	if err == nil { err = json.Unmarshal(jsonb, out) }
+	return err
+}
+
+// RegisterSwitch handles ap-switch startup, e.g. {"version": "0.1", "ifaces": ["eth1"], "interval": 30}
+func (a *Api) RegisterSwitch(ar *ApiRequest) *ApiRequest {
+	name, err := a.S.SwitchName(ar.param["switch"])
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid switch", err.Error()) }
+
+	if names, ok := ar.CertBound(name); !ok {
+		return ar.Err(http.StatusForbidden, "switch does not match client certificate", names)
+	}
+
+	info := &SwitchInfo{}
+	if err := registry_input(ar, info); err != nil {
+		return ar.Err(http.StatusBadRequest, "invalid input", err.Error())
+	}
+	info.Name, info.Addr = name, ar.req.RemoteAddr
+
+	dbg(1, "registry", "%s: registered from %s (version %s)", name, info.Addr, info.Version)
+	a.S.registry.Register(info)
+
+	ar.out, _ = a.S.registry.Get(name)
+	return ar
+}
+
+// ReportSwitch handles ap-switch heartbeats, e.g. {"states": [{"port": "eth1", "mac": ...}]}
+func (a *Api) ReportSwitch(ar *ApiRequest) *ApiRequest {
+	name, err := a.S.SwitchName(ar.param["switch"])
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid switch", err.Error()) }
+
+	if names, ok := ar.CertBound(name); !ok {
+		return ar.Err(http.StatusForbidden, "switch does not match client certificate", names)
+	}
+
+	var in struct{ States []SwitchState `json:"states"` }
+	if err := registry_input(ar, &in); err != nil {
+		return ar.Err(http.StatusBadRequest, "invalid input", err.Error())
+	}
+
+	for i := range in.States { // NB: same as @port and @mac in identities
+		in.States[i].Port = strings.ToLower(in.States[i].Port)
+		in.States[i].Mac = strings.ToLower(in.States[i].Mac)
+	}
+
+	if !a.S.registry.Report(name, ar.req.RemoteAddr, in.States) {
+		return ar.Err(http.StatusNotFound, "switch not registered", nil) // NB: will register again
+	}
+
+	ar.out = map[string]interface{}{ "states": len(in.States) }
+	return ar
+}
+
+// ListRegistry returns all known switches, add ?states=1 for the state tables
+func (a *Api) ListRegistry(ar *ApiRequest) *ApiRequest {
+	ar.out = a.S.registry.List(len(ar.query.Get("states")) > 0)
+	return ar
+}
+
+func (a *Api) GetRegistry(ar *ApiRequest) *ApiRequest {
+	name, err := a.S.SwitchName(ar.param["switch"])
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid switch", err.Error()) }
+
+	ret, ok := a.S.registry.Get(name)
+	if !ok { return ar.Err(http.StatusNotFound, "switch not registered", nil) }
+
+	ar.out = ret
+	return ar
+}
@@ -0,0 +1,37 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistryInterval(t *testing.T) {
+	r := NewRegistry()
+	r.Register(&SwitchInfo{ Name: "sw1", Interval: 1e6 })
+
+	sw := r.switches["sw1"]
+	if sw.Interval != REG_INTERVAL_MAX { t.Errorf("interval %d, want %d", sw.Interval, REG_INTERVAL_MAX) }
+
+	sw.status(sw.LastSeen.Add(REG_STALE * REG_INTERVAL_MAX * time.Second + time.Second))
+	if sw.Status != "stale" { t.Errorf("status %s, want stale", sw.Status) }
+}
@@ -0,0 +1,274 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	SEC_FILE = "security.json" // port security policy, in the switch or port directory
+	SEC_SEEN = "seen"          // last time the MAC was seen, in the MAC directory
+)
+
+var (
+	err_port_limit = errors.New("too many MAC addresses on that port")
+	err_switch_limit = errors.New("too many MAC addresses on that switch")
+)
+
+// PortSecurity controls how MACs are automatically added to a switch port
+//
+// The policy is read from the switch directory first, and then from the port directory, so that
+// the port can override any of the switch-wide values - except SwitchMaxMacs, which is read
+// from the switch directory only.
+type PortSecurity struct {
+	MaxMacs       int    `json:"max_macs"`        // max. number of MACs on the port
+	SwitchMaxMacs int    `json:"switch_max_macs"` // max. number of MACs on all ports (0: no limit)
+	Mode          string `json:"mode"`            // sticky (kept forever) or aging (removed when not seen)
+	Aging         int64  `json:"aging"`           // in aging mode: remove MACs not seen for that long (seconds)
+	Violation     string `json:"violation"`       // over the limit: deny, replace-oldest or quarantine
+}
+
+// default policy: only the first MAC on a port
+func NewPortSecurity() *PortSecurity {
+	return &PortSecurity{ MaxMacs: 1, Mode: "sticky", Aging: 86400, Violation: "deny" }
+}
+
+func (ps *PortSecurity) Verify() error {
+	switch {
+	case ps.MaxMacs < 1:
+		return fmt.Errorf("max_macs: must be positive")
+	case ps.SwitchMaxMacs < 0:
+		return fmt.Errorf("switch_max_macs: must not be negative")
+	case ps.Mode != "sticky" && ps.Mode != "aging":
+		return fmt.Errorf("mode: invalid value: %s", ps.Mode)
+	case ps.Aging < 1:
+		return fmt.Errorf("aging: must be positive")
+	}
+
+	switch ps.Violation {
+	case "deny", "replace-oldest", "quarantine": return nil
+	default: return fmt.Errorf("violation: invalid value: %s", ps.Violation)
+	}
+}
+
+// ReadSecurity returns the port security policy for given identity
+func (db *DB) ReadSecurity(id Identity) (*PortSecurity, error) {
+	ps := NewPortSecurity()
+
+	switch_max := 0
+	for i, dir := range []string{ db.SwitchPath(id), db.PortPath(id) } {
+		jsonb, err := db.st.Read(dir + "/" + SEC_FILE)
+		if os.IsNotExist(err) { continue }
+		if err == nil { err = json.Unmarshal(jsonb, ps) } // NB: overrides the keys present
+		if err != nil { return nil, fmt.Errorf("%s/%s: %s", dir, SEC_FILE, err) }
+		if i == 0 { switch_max = ps.SwitchMaxMacs }
+	}
+	ps.SwitchMaxMacs = switch_max
+
+	if err := ps.Verify(); err != nil { return nil, err }
+	return ps, nil
+}
+
+type port_mac struct {
+	mac  string
+	seen time.Time
+}
+
+// port_macs returns MACs on the port of id, least recently seen first
+//
+// In aging mode, MACs not seen for too long are removed.
+// NB: db.mutex must be held
+func (db *DB) port_macs(id Identity, ps *PortSecurity) ([]port_mac, error) {
+	port := db.PortPath(id)
+	macs, err := db.st.List(port)
+	if os.IsNotExist(err) { return nil, nil }
+	if err != nil { return nil, err }
+
+	now := time.Now()
+	ret := []port_mac{}
+	for _, m := range macs {
+		if !m.IsDir { continue }
+
+		seen := m.ModTime
+		if stat, err := db.st.Stat(port + "/" + m.Name + "/" + SEC_SEEN); err == nil { seen = stat.ModTime }
+
+		if ps.Mode == "aging" && now.Sub(seen) > time.Duration(ps.Aging) * time.Second {
+			old := Identity{ "@switch": id["@switch"], "@port": id["@port"], "@mac": m.Name }
+			dbg(2, "db", "%s: MAC aged out", db.Tag(old))
+			db.S.audit.Log("aged-out", old, "", "", "not seen since " + seen.UTC().Format(time.RFC3339))
+			if err := db.st.Remove(port + "/" + m.Name); err != nil { return nil, err }
+			db.mac_removed(old)
+			db.S.events.Notify(NewEvent("revoke", old, "MAC aged out"))
+			continue
+		}
+
+		ret = append(ret, port_mac{ m.Name, seen })
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].seen.Before(ret[j].seen) })
+	return ret, nil
+}
+
+// switch_macs returns the number of MACs on all ports of the switch of id
+//
+// NB: db.mutex must be held
+func (db *DB) switch_macs(id Identity) (int, error) {
+	ports, err := db.ListDir(db.SwitchPath(id))
+	if os.IsNotExist(err) { return 0, nil }
+	if err != nil { return 0, err }
+
+	n := 0
+	for _, port := range ports {
+		macs, err := db.ListDir(db.SwitchPath(id) + "/" + port)
+		if err != nil { return 0, err }
+		n += len(macs)
+	}
+	return n, nil
+}
+
+// AutoAdd adds the MAC of id to its port, if allowed by the port security policy
+//
+// Returns err_port_limit or err_switch_limit if over the limit (and not replacing).
+// NB: db.mutex must be held
+func (db *DB) AutoAdd(id Identity, ps *PortSecurity) error {
+	tag := db.Tag(id)
+
+	macs, err := db.port_macs(id, ps)
+	if err != nil { return err }
+
+	total := 0 // MACs on the whole switch, if limited
+	if ps.SwitchMaxMacs > 0 {
+		if total, err = db.switch_macs(id); err != nil { return err }
+	}
+
+	over := func() error {
+		switch {
+		case len(macs) >= ps.MaxMacs:                          return err_port_limit
+		case ps.SwitchMaxMacs > 0 && total >= ps.SwitchMaxMacs: return err_switch_limit
+		default:                                               return nil
+		}
+	}
+
+	// over the limit? NB: replacing a MAC on this port keeps the switch total
+	for err := over(); err != nil; err = over() {
+		if ps.Violation != "replace-oldest" || len(macs) == 0 {
+			dbg(2, "db", "%s: port has %d MAC(s), switch %d: %s", tag, len(macs), total, err)
+			return err
+		}
+
+		old := Identity{ "@switch": id["@switch"], "@port": id["@port"], "@mac": macs[0].mac }
+		dbg(2, "db", "%s: replacing least recently seen MAC %s", tag, macs[0].mac)
+		db.S.audit.Log("replaced", old, "", "", "port security: replaced by " + id["@mac"])
+		if err := db.st.Remove(db.MacPath(old)); err != nil { return err }
+		db.mac_removed(old)
+		db.S.events.Notify(NewEvent("revoke", old, "MAC replaced by " + id["@mac"]))
+		macs = macs[1:]
+		total--
+	}
+
+	err = db.st.Mkdir(db.MacPath(id))
+	if err != nil { return err }
+	db.mac_added(id)
+
+	dbg(4, "db", "%s: MAC %d of %d on port -> auto-add", tag, len(macs)+1, ps.MaxMacs)
+	db.S.audit.Log("auto-add", id, "", "",
+		fmt.Sprintf("MAC %d of %d on port", len(macs)+1, ps.MaxMacs))
+	db.S.metrics.Inc("ap_auto_add_total", "")
+	return nil
+}
+
+// Seen records that the MAC of id was just seen (for aging)
+//
+// NB: db.mutex must be held
+func (db *DB) Seen(id Identity) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	return db.st.Write(db.MacPath(id) + "/" + SEC_SEEN, []byte(now))
+}
+
+// security_path returns the policy file path for the switch (and port) given in URI params
+func (a *Api) security_path(ar *ApiRequest) (string, error) {
+	id, err := ar.ParamId()
+	if err != nil { return "", err }
+
+	if _, ok := id["@port"]; ok { return a.S.db.PortPath(id) + "/" + SEC_FILE, nil }
+	return a.S.db.SwitchPath(id) + "/" + SEC_FILE, nil
+}
+
+func (a *Api) GetSecurity(ar *ApiRequest) *ApiRequest {
+	path, err := a.security_path(ar)
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid switch or port", err.Error()) }
+
+	jsonb, err := a.S.db.st.Read(path)
+	if err != nil { return ar.Err(db_status(err), "reading policy failed", err.Error()) }
+
+	ret := make(map[string]interface{})
+	if err := json.Unmarshal(jsonb, &ret); err != nil {
+		return ar.Err(http.StatusInternalServerError, "reading policy failed", err.Error())
+	}
+
+	ar.out = ret
+	return ar
+}
+
+// PutSecurity stores the policy given in input JSON, e.g. {"max_macs": 4, "mode": "aging"}
+func (a *Api) PutSecurity(ar *ApiRequest) *ApiRequest {
+	path, err := a.security_path(ar)
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid switch or port", err.Error()) }
+
+	input, ok := ar.in.(map[string]interface{})
+	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
+
+	// validate, on top of the defaults
+	jsonb, err := json.MarshalIndent(input, "", "\t")
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid input", err.Error()) }
+
+	ps := NewPortSecurity()
+	if err := json.Unmarshal(jsonb, ps); err == nil { err = ps.Verify() }
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid policy", err.Error()) }
+	if _, ok := input["switch_max_macs"]; ok && ar.param["port"] != "" {
+		return ar.Err(http.StatusBadRequest, "invalid policy", "switch_max_macs: switch policy only")
+	}
+
+	if err := a.S.db.st.Write(path, jsonb); err != nil {
+		return ar.Err(db_status(err), "storing policy failed", err.Error())
+	}
+
+	ar.out = input
+	return ar
+}
+
+func (a *Api) DelSecurity(ar *ApiRequest) *ApiRequest {
+	path, err := a.security_path(ar)
+	if err != nil { return ar.Err(http.StatusBadRequest, "invalid switch or port", err.Error()) }
+
+	if _, err := a.S.db.st.Stat(path); err != nil { return ar.Err(db_status(err), "deleting policy failed", err.Error()) }
+	if err := a.S.db.st.Remove(path); err != nil { return ar.Err(db_status(err), "deleting policy failed", err.Error()) }
+
+	ar.out = map[string]interface{}{}
+	return ar
+}
@@ -0,0 +1,63 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSwitchMaxMacs(t *testing.T) {
+	S := &Server{}
+	st, err := NewFileStore(t.TempDir())
+	if err != nil { t.Fatal(err) }
+	S.db = &DB{ S: S, st: st }
+	db := S.db
+
+	mac := func(port string, n int) Identity {
+		return Identity{ "@switch": "sw1", "@port": port, "@mac": "00:11:22:33:44:0" + string(rune('0' + n)) }
+	}
+
+	sw_file := db.SwitchPath(mac("eth1", 0)) + "/" + SEC_FILE
+	port_file := db.PortPath(mac("eth2", 0)) + "/" + SEC_FILE
+
+	// NB: switch_max_macs in a port policy is ignored
+	if err := st.Write(sw_file, []byte(`{"max_macs": 2, "switch_max_macs": 3}`)); err != nil { t.Fatal(err) }
+	if err := st.Write(port_file, []byte(`{"switch_max_macs": 10}`)); err != nil { t.Fatal(err) }
+
+	add := func(id Identity) error {
+		ps, err := db.ReadSecurity(id)
+		if err != nil { t.Fatal(err) }
+		if ps.SwitchMaxMacs != 3 { t.Errorf("%s: switch_max_macs %d, want 3", db.Tag(id), ps.SwitchMaxMacs) }
+		return db.AutoAdd(id, ps)
+	}
+
+	for _, id := range []Identity{ mac("eth1", 1), mac("eth1", 2), mac("eth2", 3) } {
+		if err := add(id); err != nil { t.Fatalf("%s: %s", db.Tag(id), err) }
+	}
+	if err := add(mac("eth1", 4)); err != err_port_limit { t.Errorf("port limit: got %v", err) }
+	if err := add(mac("eth2", 5)); err != err_switch_limit { t.Errorf("switch limit: got %v", err) }
+	if err := add(mac("eth3", 6)); err != err_switch_limit { t.Errorf("switch limit: got %v", err) }
+
+	// replacing on the port keeps the switch total
+	if err := st.Write(port_file, []byte(`{"violation": "replace-oldest"}`)); err != nil { t.Fatal(err) }
+	if err := add(mac("eth2", 5)); err != nil { t.Errorf("replace: got %v", err) }
+	if n, _ := db.switch_macs(mac("eth2", 5)); n != 3 { t.Errorf("replace: %d MACs on switch, want 3", n) }
+}
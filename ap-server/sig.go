@@ -0,0 +1,154 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	DB_KEYS = "keys"   // trust store: keys/<manufacturer>/<name>.pub
+	SIG_EXT = ".sig"   // detached signature: <profile URL>.sig
+)
+
+var (
+	err_sig_missing = errors.New("profile signature missing")
+	err_sig_invalid = errors.New("profile signature invalid")
+	err_key_invalid = errors.New("invalid Ed25519 public key")
+)
+
+func (db *DB) KeyDir(manufacturer string) string {
+	return fmt.Sprintf("%s/%s", DB_KEYS, manufacturer)
+}
+
+func (db *DB) KeyPath(manufacturer string, name string) string {
+	return fmt.Sprintf("%s/%s/%s.pub", DB_KEYS, manufacturer, name)
+}
+
+// parse_key decodes a base64-encoded Ed25519 public key
+func parse_key(val string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+	if err != nil || len(raw) != ed25519.PublicKeySize { return nil, err_key_invalid }
+	return ed25519.PublicKey(raw), nil
+}
+
+// TrustedKeys returns all public keys trusted for given (escaped) manufacturer, by name
+func (db *DB) TrustedKeys(manufacturer string) (map[string]ed25519.PublicKey, error) {
+	files, err := db.st.List(db.KeyDir(manufacturer))
+	if os.IsNotExist(err) { return nil, nil }
+	if err != nil { return nil, err }
+
+	keys := make(map[string]ed25519.PublicKey)
+	for _, f := range files {
+		if f.IsDir || !strings.HasSuffix(f.Name, ".pub") { continue }
+		name := strings.TrimSuffix(f.Name, ".pub")
+
+		val, err := db.st.Read(db.KeyPath(manufacturer, name))
+		if err != nil { return nil, err }
+
+		key, err := parse_key(string(val))
+		if err != nil { dbg(1, "sig", "%s/%s: %s", manufacturer, name, err); continue }
+		keys[name] = key
+	}
+
+	return keys, nil
+}
+
+// VerifySig checks the detached signature of a profile fetched from src
+//
+// Returns the name of the key that verified the profile, or empty string if the profile was
+// accepted without verification, depending on the -sig option.
+func (db *DB) VerifySig(manufacturer string, src string, pfbytes []byte) (string, error) {
+	if db.S.opts.sig == "off" { return "", nil }
+
+	keys, err := db.TrustedKeys(manufacturer)
+	if err != nil { return "", err }
+	if len(keys) == 0 {
+		if db.S.opts.sig == "require" { return "", err_sig_missing }
+		return "", nil // no keys for this manufacturer, accept
+	}
+
+	// fetch the signature
+	sigbytes, status, err := db.S.http_get(src + SIG_EXT)
+	if err != nil { return "", err }
+	if status != http.StatusOK { return "", err_sig_missing }
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigbytes)))
+	if err != nil { return "", err_sig_invalid }
+
+	for name, key := range keys {
+		if ed25519.Verify(key, pfbytes, sig) { return manufacturer + "/" + name, nil }
+	}
+
+	return "", err_sig_invalid
+}
+
+func (a *Api) ListKeys(ar *ApiRequest) *ApiRequest {
+	manufacturer := escape(ar.param["manufacturer"])
+
+	keys, err := a.S.db.TrustedKeys(manufacturer)
+	if err != nil { return ar.Err(db_status(err), "listing keys failed", err.Error()) }
+
+	ret := make(map[string]string)
+	for name, key := range keys { ret[name] = base64.StdEncoding.EncodeToString(key) }
+
+	ar.out = ret
+	return ar
+}
+
+// PutKey stores a trusted key given in input JSON as {"key": "<base64>"}
+func (a *Api) PutKey(ar *ApiRequest) *ApiRequest {
+	manufacturer, name := escape(ar.param["manufacturer"]), escape(ar.param["name"])
+	if len(manufacturer) == 0 || len(name) == 0 {
+		return ar.Err(http.StatusBadRequest, "invalid key name", nil)
+	}
+
+	input, ok := ar.in.(map[string]interface{})
+	if !ok { return ar.Err(http.StatusBadRequest, "invalid input", nil) }
+
+	val, _ := input["key"].(string)
+	key, err := parse_key(val)
+	if err != nil { return ar.Err(http.StatusBadRequest, err.Error(), nil) }
+
+	enc := base64.StdEncoding.EncodeToString(key)
+	err = a.S.db.st.Write(a.S.db.KeyPath(manufacturer, name), []byte(enc + "\n"))
+	if err != nil { return ar.Err(db_status(err), "storing key failed", err.Error()) }
+
+	dbg(1, "sig", "%s/%s: stored trusted key", manufacturer, name)
+	ar.out = map[string]string{ name: enc }
+	return ar
+}
+
+func (a *Api) DelKey(ar *ApiRequest) *ApiRequest {
+	manufacturer, name := escape(ar.param["manufacturer"]), escape(ar.param["name"])
+
+	err := a.S.db.st.Remove(a.S.db.KeyPath(manufacturer, name))
+	if err != nil { return ar.Err(db_status(err), "deleting key failed", err.Error()) }
+
+	dbg(1, "sig", "%s/%s: deleted trusted key", manufacturer, name)
+	ar.out = name
+	return ar
+}
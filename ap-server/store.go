@@ -0,0 +1,177 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Store is the storage backend of DB
+//
+// It holds files under slash-separated paths, organized in directories, just like the original
+// filesystem layout of the -db directory. Missing paths are reported with errors that satisfy
+// os.IsNotExist().
+type Store interface {
+	Stat(path string) (StoreEntry, error)
+	List(path string) ([]StoreEntry, error)     // directory entries, sorted by name
+	Read(path string) ([]byte, error)
+	Write(path string, data []byte) error       // creates parent directories
+	Mkdir(path string) error                    // creates parent directories
+	Remove(path string) error                   // removes directories recursively
+	Rename(src string, dst string) error        // creates parent directories of dst
+	Close() error
+}
+
+type StoreEntry struct {
+	Name    string
+	IsDir   bool
+	ModTime time.Time
+}
+
+// NewStore opens the storage backend of given kind
+func NewStore(kind string, path string) (Store, error) {
+	switch kind {
+	case "fs":   return NewFileStore(path)
+	case "bolt": return NewBoltStore(path)
+	default:     return nil, fmt.Errorf("invalid storage backend: %s", kind)
+	}
+}
+
+// CopyStore recursively copies everything under path from src to dst
+func CopyStore(dst Store, src Store, path string) (files int, err error) {
+	entries, err := src.List(path)
+	if err != nil { return 0, err }
+
+	for _, e := range entries {
+		p := e.Name
+		if len(path) > 0 { p = path + "/" + e.Name }
+
+		if e.IsDir {
+			if err := dst.Mkdir(p); err != nil { return files, err }
+			n, err := CopyStore(dst, src, p)
+			files += n
+			if err != nil { return files, err }
+		} else {
+			data, err := src.Read(p)
+			if err == nil { err = dst.Write(p, data) }
+			if err != nil { return files, err }
+			files++
+		}
+	}
+
+	return files, nil
+}
+
+// WalkStore recursively calls fn for each file under path, with its contents
+func WalkStore(st Store, path string, fn func(path string, data []byte) error) error {
+	entries, err := st.List(path)
+	if err != nil { return err }
+
+	for _, e := range entries {
+		p := path + "/" + e.Name
+
+		if e.IsDir {
+			err = WalkStore(st, p, fn)
+		} else {
+			var data []byte
+			data, err = st.Read(p)
+			if err == nil { err = fn(p, data) }
+		}
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+// FileStore keeps everything in a filesystem directory
+type FileStore struct {
+	root string
+}
+
+func NewFileStore(root string) (*FileStore, error) {
+	if err := os.MkdirAll(root, 0750); err != nil { return nil, err }
+	return &FileStore{root}, nil
+}
+
+func (fs *FileStore) path(path string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(path))
+}
+
+func (fs *FileStore) Stat(path string) (StoreEntry, error) {
+	stat, err := os.Stat(fs.path(path))
+	if err != nil { return StoreEntry{}, err }
+	return StoreEntry{ stat.Name(), stat.IsDir(), stat.ModTime() }, nil
+}
+
+func (fs *FileStore) List(path string) ([]StoreEntry, error) {
+	files, err := ioutil.ReadDir(fs.path(path))
+	if err != nil { return nil, err }
+
+	ret := make([]StoreEntry, 0, len(files))
+	for _, f := range files {
+		ret = append(ret, StoreEntry{ f.Name(), f.IsDir(), f.ModTime() })
+	}
+	return ret, nil
+}
+
+func (fs *FileStore) Read(path string) ([]byte, error) {
+	return ioutil.ReadFile(fs.path(path))
+}
+
+func (fs *FileStore) Write(path string, data []byte) error {
+	p := fs.path(path)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil { return err }
+
+	// write atomically, NB: unique temporary file for concurrent writers
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p) + ".*.tmp")
+	if err != nil { return err }
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil { err = f.Chmod(0640) }
+	if err2 := f.Close(); err == nil { err = err2 }
+	if err == nil { err = os.Rename(tmp, p) }
+	if err != nil { os.Remove(tmp) }
+	return err
+}
+
+func (fs *FileStore) Mkdir(path string) error {
+	return os.MkdirAll(fs.path(path), 0755)
+}
+
+func (fs *FileStore) Remove(path string) error {
+	p := fs.path(path)
+	if _, err := os.Lstat(p); err != nil { return err }
+	return os.RemoveAll(p)
+}
+
+func (fs *FileStore) Rename(src string, dst string) error {
+	d := fs.path(dst)
+	if err := os.MkdirAll(filepath.Dir(d), 0755); err != nil { return err }
+	return os.Rename(fs.path(src), d)
+}
+
+func (fs *FileStore) Close() error {
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+var bolt_bucket = []byte("db")
+
+// BoltStore keeps everything in a single bbolt file
+//
+// Each file is stored under its path, with the value prefixed by 8 bytes of modification time
+// (UNIX nanoseconds, big-endian). Each directory is stored under its path with a trailing '/'.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0640, &bolt.Options{ Timeout: time.Second })
+	if err != nil { return nil, err }
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bolt_bucket)
+		return err
+	})
+	if err != nil { db.Close(); return nil, err }
+
+	return &BoltStore{db}, nil
+}
+
+func bolt_notexist(op string, path string) error {
+	return &os.PathError{ Op: op, Path: path, Err: os.ErrNotExist }
+}
+
+func bolt_name(path string) string {
+	path = strings.TrimRight(path, "/")
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+func bolt_value(data []byte) []byte {
+	val := make([]byte, 8 + len(data))
+	binary.BigEndian.PutUint64(val, uint64(time.Now().UnixNano()))
+	copy(val[8:], data)
+	return val
+}
+
+func bolt_mtime(val []byte) time.Time {
+	if len(val) < 8 { return time.Time{} }
+	return time.Unix(0, int64(binary.BigEndian.Uint64(val)))
+}
+
+// bolt_mkdir creates directory markers for path and all its parents
+func bolt_mkdir(b *bolt.Bucket, path string) error {
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' { continue }
+		if err := b.Put([]byte(path[:i+1]), bolt_value(nil)); err != nil { return err }
+	}
+	if len(path) == 0 || path[len(path)-1] == '/' { return nil }
+	return b.Put([]byte(path + "/"), bolt_value(nil))
+}
+
+func bolt_parent(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i > 0 { return path[:i] }
+	return ""
+}
+
+func (bs *BoltStore) Stat(path string) (ret StoreEntry, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bolt_bucket)
+		if len(path) == 0 {
+			ret = StoreEntry{ "", true, time.Time{} }
+		} else if val := b.Get([]byte(path)); val != nil {
+			ret = StoreEntry{ bolt_name(path), false, bolt_mtime(val) }
+		} else if val := b.Get([]byte(path + "/")); val != nil {
+			ret = StoreEntry{ bolt_name(path), true, bolt_mtime(val) }
+		} else {
+			return bolt_notexist("stat", path)
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) List(path string) (ret []StoreEntry, err error) {
+	prefix := ""
+	if len(path) > 0 { prefix = path + "/" }
+
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bolt_bucket).Cursor()
+		if len(prefix) > 0 && c.Bucket().Get([]byte(prefix)) == nil {
+			return bolt_notexist("list", path)
+		}
+
+		ret = []StoreEntry{}
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			rest := string(k[len(prefix):])
+			switch i := strings.IndexByte(rest, '/'); {
+			case len(rest) == 0:
+				continue // the directory itself
+			case i < 0:
+				ret = append(ret, StoreEntry{ rest, false, bolt_mtime(v) })
+			case i == len(rest)-1:
+				ret = append(ret, StoreEntry{ rest[:i], true, bolt_mtime(v) })
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) Read(path string) (ret []byte, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(bolt_bucket).Get([]byte(path))
+		if val == nil { return bolt_notexist("read", path) }
+		ret = append([]byte(nil), val[8:]...)
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) Write(path string, data []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bolt_bucket)
+		if err := bolt_mkdir(b, bolt_parent(path)); err != nil { return err }
+		return b.Put([]byte(path), bolt_value(data))
+	})
+}
+
+func (bs *BoltStore) Mkdir(path string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return bolt_mkdir(tx.Bucket(bolt_bucket), path)
+	})
+}
+
+// bolt_keys returns the file key and all keys under directory path
+func bolt_keys(b *bolt.Bucket, path string) (keys [][]byte) {
+	if b.Get([]byte(path)) != nil { keys = append(keys, []byte(path)) }
+
+	prefix := []byte(path + "/")
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return
+}
+
+func (bs *BoltStore) Remove(path string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bolt_bucket)
+
+		keys := bolt_keys(b, path)
+		if len(keys) == 0 { return bolt_notexist("remove", path) }
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil { return err }
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) Rename(src string, dst string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bolt_bucket)
+
+		keys := bolt_keys(b, src)
+		if len(keys) == 0 { return bolt_notexist("rename", src) }
+		if err := bolt_mkdir(b, bolt_parent(dst)); err != nil { return err }
+
+		for _, k := range keys {
+			val := append([]byte(nil), b.Get(k)...)
+			if err := b.Put([]byte(dst + string(k[len(src):])), val); err != nil { return err }
+			if err := b.Delete(k); err != nil { return err }
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
@@ -0,0 +1,53 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestFileStoreWriteConcurrent(t *testing.T) {
+	st, err := NewFileStore(t.TempDir())
+	if err != nil { t.Fatal(err) }
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- st.Write("dir/file.json", []byte(fmt.Sprintf(`{"writer": %d}`, i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil { t.Error(err) }
+	}
+
+	if _, err := st.Read("dir/file.json"); err != nil { t.Fatal(err) }
+
+	files, err := st.List("dir")
+	if err != nil { t.Fatal(err) }
+	if len(files) != 1 { t.Errorf("%d files left, want 1", len(files)) }
+}
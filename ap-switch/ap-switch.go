@@ -40,6 +40,8 @@ const (
 
 	AUTHZ_TIMEOUT = 10             // authorization timeout (in seconds)
 	AUTHZ_RETRY_TIMEOUT = 3        // how quickly to retry authz attempts
+	AUTHZ_PENDING_RETRY = 5        // how quickly to retry authz while pending approval
+	AUTHZ_PENDING_TIMEOUT = 600    // how long to wait for approval (in seconds)
 
 	PROV_TIMEOUT = 3               // provision timeout (in seconds)
 	PROV_RETRY_TIMEOUT = 1         // how quickly to retry provision attempts
@@ -48,7 +50,8 @@ const (
 type Switch struct {
 	ctx      context.Context
 	hostname string
-	http     http.Client
+	http     http.Client  // for devices
+	authz    http.Client  // for ap-server
 
 	opts struct {
 		dbg            int
@@ -58,11 +61,18 @@ type Switch struct {
 		// --
 		auth_query     string
 		authz_query    string
+		tls_cert       string
+		tls_key        string
+		tls_ca         string
+		events         string
+		registry       string
+		heartbeat      int
 	}
 	
 	tcpref             int                     // global TC preference counter
 	snifferq           chan SnifferMsg         // MAC-IP sniffer output
 	state              map[string]*State       // port-MAC states
+	statemu            sync.RWMutex            // protects the state map
 
 	auth_query         *fasttemplate.Template
 	authz_query        *fasttemplate.Template
@@ -83,6 +93,8 @@ type State struct {
 	state       int         // current state
 	since       int64       // UNIX timestamp of last state update
 	timeout     int64       // UNIX timestamp when current state times out
+	source      string      // source of the provisioned profile
+	gen         int64       // bumped on revoke, to discard the auth in progress
 }
 
 const (
@@ -125,6 +137,15 @@ func main() {
 		"authentication query (HTTP GET) used to fetch the identity")
 	flag.StringVar(&S.opts.authz_query, "authz", "http://192.168.100.128:30000/v1/authorize",
 		"authorization query (HTTP POST) used to fetch the profile")
+	flag.StringVar(&S.opts.tls_cert, "tls-cert", "",
+		"client certificate (PEM) for https:// -authz queries, its name should match -me")
+	flag.StringVar(&S.opts.tls_key, "tls-key", "", "private key for -tls-cert (PEM)")
+	flag.StringVar(&S.opts.tls_ca, "tls-ca", "", "CA (PEM) to verify ap-server with, instead of system CAs")
+	flag.StringVar(&S.opts.events, "events", "",
+		"subscribe to ap-server change notifications, e.g. http://192.168.100.128:30000/v1/events")
+	flag.StringVar(&S.opts.registry, "registry", "",
+		"register and report state to ap-server, e.g. http://192.168.100.128:30000/v1/switches")
+	flag.IntVar(&S.opts.heartbeat, "heartbeat", 30, "-registry heartbeat interval (in seconds)")
 
 	flag.Parse()
 	dbgSet(S.opts.dbg)
@@ -132,6 +153,7 @@ func main() {
 	// read interfaces
 	S.opts.ifaces = flag.Args()
 	if len(S.opts.ifaces) == 0 { die("main", "no interfaces given on command-line") }
+	if S.opts.heartbeat < 1 { die("main", "-heartbeat: must be positive") }
 
 	// parse templates
 	q := strings.Replace(S.opts.auth_query, "://<ip>", "://<ip-host>", 1)
@@ -172,12 +194,16 @@ func main() {
 
 	// read from sniffers
 	S.state = make(map[string]*State)
+	if len(S.opts.events) > 0 { go S.events() }
+	if len(S.opts.registry) > 0 { go S.registry() }
 	for msg := range S.snifferq {
 		dbg(3, "main", "sniffer: seen PORT/MAC/IP: %s/%s/%s", msg.iface, msg.mac, msg.ip)
 
 		// need to authenticate?
 		key := fmt.Sprintf("%s/%s", msg.iface, msg.mac)
+		S.statemu.RLock()
 		st, ok := S.state[key]
+		S.statemu.RUnlock()
 		if !ok { // yes, new stuff, needs auth
 			st = &State{}
 			st.mutex.Lock()
@@ -189,7 +215,9 @@ func main() {
 
 			dbg(3, "main", "%s: new PORT/MAC using IP %s", st.tag, st.lastip)
 
+			S.statemu.Lock()
 			S.state[key] = st
+			S.statemu.Unlock()
 		} else { // lets check...
 			st.mutex.Lock()
 
@@ -37,6 +37,7 @@ var (
 	err_state_timeout = errors.New("timeout")
 	err_state_json = errors.New("JSON error")
 	err_http_200 = errors.New("HTTP status not 200 OK")
+	err_state_pending = errors.New("pending approval")
 )
 
 // state_start_auth tries to move state from STATE_NEEDS_AUTH to STATE_ON
@@ -51,14 +52,22 @@ func (S *Switch) state_start_auth(st *State) {
 	st.mutex.RLock()
 	timeout := st.timeout
 	state := st.state
+	gen := st.gen
 	st.mutex.RUnlock()
 	if state != STATE_NEEDS_AUTH || nanotime() > timeout {
 		dbg(0, "state", "%s: invalid starting point", tag)
 		return
 	}
 
+	// move moves the state, unless revoked in the meantime
+	move := func(state int, timeout int64) bool {
+		if st.state_move_gen(gen, state, timeout) { return true }
+		dbg(2, "state", "%s: revoked during auth: aborting", tag)
+		return false
+	}
+
 	// authenticate
-	st.state_move(STATE_IN_AUTH, AUTH_TIMEOUT)
+	if !move(STATE_IN_AUTH, AUTH_TIMEOUT) { return }
 	for i := 1; identity == nil; i++ {
 		identity, err = S.state_authenticate(st)
 		switch err {
@@ -66,6 +75,9 @@ func (S *Switch) state_start_auth(st *State) {
 			dbg(2, "state", "%s: authenticated: %#v", tag, identity)
 		case err_state_timeout:
 			dbg(2, "state", "%s: authentication timeout: will use empty identity", tag)
+		case err_state:
+			dbg(2, "state", "%s: state changed during authentication: aborting", tag)
+			return
 		default:
 			dbg(2, "state", "%s: authentication failed (try %d): %s", tag, i, err)
 			time.Sleep(AUTH_RETRY_TIMEOUT * 1e9)
@@ -73,7 +85,8 @@ func (S *Switch) state_start_auth(st *State) {
 	}
 
 	// authorize
-	st.state_move(STATE_IN_AUTHZ, AUTHZ_TIMEOUT)
+	if !move(STATE_IN_AUTHZ, AUTHZ_TIMEOUT) { return }
+	pending := int64(0) // since when waiting for approval
 	for i := 1; profile == nil; i++ {
 		profile, err = S.state_authorize(st, identity)
 		switch err {
@@ -82,6 +95,21 @@ func (S *Switch) state_start_auth(st *State) {
 		case err_state_timeout:
 			dbg(2, "state", "%s: authorization timeout: aborting", tag)
 			return
+		case err_state:
+			dbg(2, "state", "%s: state changed during authorization: aborting", tag)
+			return
+		case err_state_pending:
+			if pending == 0 { pending = nanotime() }
+			if nanotime() - pending > AUTHZ_PENDING_TIMEOUT*1e9 {
+				dbg(2, "state", "%s: not approved in time: access denied for 1 minute", tag)
+				move(STATE_OFF, 60)
+				return
+			}
+
+			// keep waiting
+			dbg(3, "state", "%s: pending approval (try %d)", tag, i)
+			if !move(STATE_IN_AUTHZ, AUTHZ_TIMEOUT) { return }
+			time.Sleep(AUTHZ_PENDING_RETRY * 1e9)
 		default:
 			if profile == nil {
 				dbg(2, "state", "%s: authorization failed (try %d): %s", tag, i, err)
@@ -89,31 +117,41 @@ func (S *Switch) state_start_auth(st *State) {
 			} else {
 				// access denied for next 5-15 min
 				dbg(2, "state", "%s: access denied: %s", tag, err)
-				st.state_move(STATE_OFF, 300 + rand.Int63n(600))
+				move(STATE_OFF, 300 + rand.Int63n(600))
 				return
 			}
 		}
 	}
 
 	// start provisioning
-	st.state_move(STATE_IN_PROV, PROV_TIMEOUT)
+	if !move(STATE_IN_PROV, PROV_TIMEOUT) { return }
 	err = S.state_provision(st, profile)
 	switch err {
 	case nil:
+		st.mutex.Lock()
+		if st.gen != gen { // NB: revoked while provisioning, the revoke might have run first
+			st.mutex.Unlock()
+			dbg(2, "state", "%s: revoked during provisioning: deprovisioning", tag)
+			S.tc_deprovision(st, nil)
+			return
+		}
 		dbg(2, "state", "%s: provisioned", tag)
+		st.source, _ = profile["@source"].(string)
+		if _, ok := profile["@empty"]; ok { st.source = "empty" }
+		st.mutex.Unlock()
 	case err_state_timeout:
 		dbg(2, "state", "%s: provisioning timeout: aborting", tag)
 		return
 	default:
 		dbg(2, "state", "%s: provisioning failed (ban for 1 minute): %s", tag, err)
-		st.state_move(STATE_OFF, 60) // access denied for next 1 min
+		move(STATE_OFF, 60) // access denied for next 1 min
 		return
 	}
 
 	// mark port as done, will re-auth after random 1-24h delay
 	//st.state_move(STATE_ON, 3600 + rand.Int63n(82800))
 	// TODO: temporary
-	st.state_move(STATE_ON, 300)
+	move(STATE_ON, 300)
 }
 
 func (st *State) state_move(state int, timeout int64) {
@@ -124,6 +162,18 @@ func (st *State) state_move(state int, timeout int64) {
 	st.mutex.Unlock()
 }
 
+// state_move_gen is state_move, unless st.gen is no longer gen (returns false)
+func (st *State) state_move_gen(gen int64, state int, timeout int64) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.gen != gen { return false }
+
+	st.state = state
+	st.since = nanotime()
+	st.timeout = st.since + timeout*1e9
+	return true
+}
+
 func (S *Switch) state_compile_target(template *fasttemplate.Template, st *State, lastip net.IP) string {
 	return template.ExecuteFuncString(fasttemplate.TagFunc(
 	func (w io.Writer, tag string) (int, error) {
@@ -229,6 +279,9 @@ func (S *Switch) state_authorize(st *State, identity map[string]interface{}) (ma
 	profile, ok := out.(map[string]interface{})
 	if !ok { return nil, fmt.Errorf("HTTP status %d: not an object: %s", status, out) }
 
+	// 202 (HTTP Accepted) means the MAC is waiting for approval
+	if status == http.StatusAccepted { return nil, err_state_pending }
+
 	// status != 200 means authorization failed
 	if status != http.StatusOK {
 		if e, ok := profile["error"].(map[string]interface{}); ok {
@@ -0,0 +1,129 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	EVENTS_RETRY = 5 // how quickly to reconnect to ap-server (in seconds)
+)
+
+// Event is a change notification from ap-server
+type Event struct {
+	Action string `json:"action"` // reauth or revoke
+	Switch string `json:"switch"`
+	Port   string `json:"port"`   // empty means all ports
+	Mac    string `json:"mac"`    // empty means all MACs
+	Reason string `json:"reason"`
+}
+
+// events subscribes to change notifications from ap-server, forever
+func (S *Switch) events() {
+	target := S.opts.events
+	if strings.Contains(target, "?") { target += "&" } else { target += "?" }
+	target += "switch=" + url.QueryEscape(S.opts.me)
+
+	for {
+		err := S.events_read(target)
+		dbg(1, "events", "%s: %s (will retry)", target, err)
+		time.Sleep(EVENTS_RETRY * 1e9)
+	}
+}
+
+// events_read reads the Server-Sent Events stream at target, until error
+func (S *Switch) events_read(target string) error {
+	req, err := http.NewRequestWithContext(S.ctx, "GET", target, nil)
+	if err != nil { return err }
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := S.authz.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK { return E("HTTP status %d", resp.StatusCode) }
+
+	dbg(1, "events", "subscribed to %s", target)
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "data:") { continue } // NB: skip event names and comments
+
+		var ev Event
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &ev); err != nil {
+			dbg(1, "events", "invalid event: %s: %s", err, line)
+			continue
+		}
+		S.events_handle(&ev)
+	}
+
+	if err := sc.Err(); err != nil { return err }
+	return E("connection closed")
+}
+
+// events_handle applies ev to all matching port-MAC states
+func (S *Switch) events_handle(ev *Event) {
+	dbg(2, "events", "%s %s/%s: %s", ev.Action, ev.Port, ev.Mac, ev.Reason)
+
+	S.statemu.RLock()
+	defer S.statemu.RUnlock()
+
+	for _, st := range S.state {
+		if len(ev.Port) > 0 && !strings.EqualFold(ev.Port, st.iface) { continue } // NB: ap-server lowercases
+		if len(ev.Mac) > 0 && ev.Mac != st.mac.String() { continue }
+
+		switch ev.Action {
+		case "reauth":
+			st.mutex.Lock()
+			switch st.state {
+			case STATE_ON, STATE_OFF: // not in progress
+				st.state = STATE_NEEDS_AUTH
+				st.since = nanotime()
+				st.timeout = st.since + 5e9 // give it 5 sec
+				st.mutex.Unlock()
+
+				dbg(2, "events", "%s: re-authorizing: %s", st.tag, ev.Reason)
+				go S.state_start_auth(st)
+			default:
+				st.mutex.Unlock()
+			}
+
+		case "revoke":
+			dbg(2, "events", "%s: deprovisioning: %s", st.tag, ev.Reason)
+			st.mutex.Lock()
+			st.gen++ // NB: auth in progress will discard its result, see state_start_auth
+			st.source = ""
+			st.state = STATE_OFF
+			st.since = nanotime()
+			st.timeout = st.since // NB: re-auth on next packet
+			st.mutex.Unlock()
+			S.tc_deprovision(st, nil)
+
+		default:
+			dbg(1, "events", "%s: unknown action: %s", st.tag, ev.Action)
+		}
+	}
+}
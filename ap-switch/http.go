@@ -26,6 +26,8 @@ import (
 	"time"
 	"net/http"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 )
 
 const (
@@ -43,6 +45,28 @@ func (S *Switch) http_init() {
 	S.http.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		return http.ErrUseLastResponse
 	}
+
+	// ap-server connection: same, but with our client certificate and the server CA
+	tlsconf := &tls.Config{ MinVersion: tls.VersionTLS12 }
+	if len(S.opts.tls_cert) > 0 {
+		cert, err := tls.LoadX509KeyPair(S.opts.tls_cert, S.opts.tls_key)
+		if err != nil { die("http", "-tls-cert: %s", err) }
+		tlsconf.Certificates = []tls.Certificate{ cert }
+	}
+	if len(S.opts.tls_ca) > 0 {
+		pem, err := ioutil.ReadFile(S.opts.tls_ca)
+		if err != nil { die("http", "-tls-ca: %s", err) }
+
+		tlsconf.RootCAs = x509.NewCertPool()
+		if !tlsconf.RootCAs.AppendCertsFromPEM(pem) { die("http", "-tls-ca: no certificates found") }
+	}
+
+	S.authz.Transport = &http.Transport{
+		MaxIdleConns:       100,
+		IdleConnTimeout:    30 * time.Second,
+		TLSClientConfig:    tlsconf,
+	}
+	S.authz.CheckRedirect = S.http.CheckRedirect
 }
 
 func (S *Switch) http_get(url string) ([]byte, int, error) {
@@ -73,7 +97,7 @@ func (S *Switch) http_post_json(url string, data interface{}) (interface{}, int,
 
 	// do the query
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := S.http.Do(req)
+	resp, err := S.authz.Do(req)
 	if err != nil { return nil, -3, err }
 	defer resp.Body.Close()
 
@@ -0,0 +1,89 @@
+/*
+ * Autopolicy PoC
+ * Copyright (C) 2019-2020 IITiS PAN Gliwice <https://www.iitis.pl/>
+ * Author: Pawel Foremski <pjf@iitis.pl>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// names of STATE_* values, as reported to ap-server
+var state_names = []string{
+	"off", "needs-auth", "in-auth", "authenticated", "in-authz", "authorized", "in-prov", "on",
+}
+
+// registry registers with ap-server and reports the state table every -heartbeat, forever
+func (S *Switch) registry() {
+	base := S.opts.registry + "/" + url.PathEscape(S.opts.me)
+	registered := false
+
+	for ; ; time.Sleep(time.Duration(S.opts.heartbeat) * time.Second) {
+		if !registered {
+			_, status, err := S.http_post_json(base + "/register", map[string]interface{}{
+				"version":  VERSION,
+				"ifaces":   S.opts.ifaces,
+				"interval": S.opts.heartbeat,
+			})
+			if err == nil && status != http.StatusOK { err = E("HTTP status %d", status) }
+			if err != nil { dbg(1, "registry", "registration failed: %s", err); continue }
+
+			dbg(1, "registry", "registered at %s", S.opts.registry)
+			registered = true
+		}
+
+		_, status, err := S.http_post_json(base + "/report", map[string]interface{}{
+			"states": S.registry_states(),
+		})
+		switch {
+		case err != nil:
+			dbg(2, "registry", "heartbeat failed: %s", err)
+		case status == http.StatusNotFound: // e.g. ap-server restarted
+			dbg(1, "registry", "not registered anymore, will register again")
+			registered = false
+		case status != http.StatusOK:
+			dbg(2, "registry", "heartbeat failed: HTTP status %d", status)
+		}
+	}
+}
+
+// registry_states returns a copy of the state table
+func (S *Switch) registry_states() []map[string]interface{} {
+	now := nanotime()
+
+	S.statemu.RLock()
+	defer S.statemu.RUnlock()
+
+	ret := []map[string]interface{}{}
+	for _, st := range S.state {
+		st.mutex.RLock()
+		ret = append(ret, map[string]interface{}{
+			"port":   st.iface,
+			"mac":    st.mac.String(),
+			"state":  state_names[st.state],
+			"lastip": st.lastip.String(),
+			"age":    float64(now - st.since) / 1e9,
+			"source": st.source,
+		})
+		st.mutex.RUnlock()
+	}
+
+	return ret
+}